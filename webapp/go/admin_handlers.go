@@ -0,0 +1,1087 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+	"github.com/samber/lo"
+)
+
+type adminZoneRectangle struct {
+	Min Coordinate `json:"min"`
+	Max Coordinate `json:"max"`
+}
+
+// polygon か rectangle のどちらかを指定する
+type adminPutZoneRequest struct {
+	Name            string              `json:"name" validate:"required"`
+	Polygon         []Coordinate        `json:"polygon"`
+	Rectangle       *adminZoneRectangle `json:"rectangle"`
+	FareRatePercent *int                `json:"fare_rate_percent" validate:"min=1"`
+	AdjacentZoneIDs []string            `json:"adjacent_zone_ids"`
+}
+
+type adminZone struct {
+	ID              string       `json:"id"`
+	Name            string       `json:"name"`
+	Polygon         []Coordinate `json:"polygon"`
+	FareRatePercent int          `json:"fare_rate_percent"`
+	AdjacentZoneIDs []string     `json:"adjacent_zone_ids"`
+}
+
+type adminGetZonesResponse struct {
+	Zones []adminZone `json:"zones"`
+}
+
+func (req *adminPutZoneRequest) validate() ([]Coordinate, error) {
+	var polygon []Coordinate
+	switch {
+	case req.Rectangle != nil && req.Polygon != nil:
+		return nil, errors.New("only one of polygon or rectangle can be specified")
+	case req.Rectangle != nil:
+		rect := req.Rectangle
+		if rect.Min.Latitude >= rect.Max.Latitude || rect.Min.Longitude >= rect.Max.Longitude {
+			return nil, errors.New("rectangle min must be less than max")
+		}
+		polygon = []Coordinate{
+			{Latitude: rect.Min.Latitude, Longitude: rect.Min.Longitude},
+			{Latitude: rect.Min.Latitude, Longitude: rect.Max.Longitude},
+			{Latitude: rect.Max.Latitude, Longitude: rect.Max.Longitude},
+			{Latitude: rect.Max.Latitude, Longitude: rect.Min.Longitude},
+		}
+	default:
+		if len(req.Polygon) < 3 {
+			return nil, errors.New("polygon must have at least 3 vertices")
+		}
+		polygon = req.Polygon
+	}
+	return polygon, nil
+}
+
+func adminGetZones(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	_, span := tracer.Start(ctx, "adminGetZones")
+	defer span.End()
+
+	items, err := selectAdminZones(ctx, db)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &adminGetZonesResponse{Zones: items})
+}
+
+func adminPostZones(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	_, span := tracer.Start(ctx, "adminPostZones")
+	defer span.End()
+
+	putZone(w, r, ulid.Make().String(), true)
+}
+
+func adminPutZone(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	_, span := tracer.Start(ctx, "adminPutZone")
+	defer span.End()
+
+	putZone(w, r, r.PathValue("zone_id"), false)
+}
+
+func putZone(w http.ResponseWriter, r *http.Request, zoneID string, create bool) {
+	ctx := r.Context()
+
+	admin, err := AdminFrom(ctx)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	req := &adminPutZoneRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	polygon, err := req.validate()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	polygonJSON, err := json.Marshal(polygon)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	fareRatePercent := 100
+	if req.FareRatePercent != nil {
+		fareRatePercent = *req.FareRatePercent
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	if create {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO zones (id, name, polygon, fare_rate_percent) VALUES (?, ?, ?, ?)`, zoneID, req.Name, string(polygonJSON), fareRatePercent); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	} else {
+		result, err := tx.ExecContext(ctx, `UPDATE zones SET name = ?, polygon = ?, fare_rate_percent = ?, updated_at = CURRENT_TIMESTAMP(6) WHERE id = ?`, req.Name, string(polygonJSON), fareRatePercent, zoneID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		} else if n == 0 {
+			writeError(w, http.StatusNotFound, errors.New("zone not found"))
+			return
+		}
+	}
+
+	if err := replaceZoneAdjacencies(ctx, tx, zoneID, req.AdjacentZoneIDs); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusBadRequest, errors.New("adjacent zone not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	action := "zone.update"
+	if create {
+		action = "zone.create"
+	}
+	if err := insertAdminAuditLog(ctx, tx, admin, action, "zone", zoneID, req); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := loadZones(ctx, db); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if req.AdjacentZoneIDs == nil {
+		req.AdjacentZoneIDs = []string{}
+	}
+	status := http.StatusOK
+	if create {
+		status = http.StatusCreated
+	}
+	writeJSON(w, status, &adminZone{
+		ID:              zoneID,
+		Name:            req.Name,
+		Polygon:         polygon,
+		FareRatePercent: fareRatePercent,
+		AdjacentZoneIDs: req.AdjacentZoneIDs,
+	})
+}
+
+func adminDeleteZone(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	_, span := tracer.Start(ctx, "adminDeleteZone")
+	defer span.End()
+
+	zoneID := r.PathValue("zone_id")
+
+	admin, err := AdminFrom(ctx)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM zones WHERE id = ?`, zoneID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if n == 0 {
+		writeError(w, http.StatusNotFound, errors.New("zone not found"))
+		return
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM zone_adjacencies WHERE zone_id = ? OR adjacent_zone_id = ?`, zoneID, zoneID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := insertAdminAuditLog(ctx, tx, admin, "zone.delete", "zone", zoneID, nil); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := loadZones(ctx, db); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// 隣接関係は両方向に登録し直す。存在しないゾーンを指定したら sql.ErrNoRows を返す
+func replaceZoneAdjacencies(ctx context.Context, tx *sqlx.Tx, zoneID string, adjacentZoneIDs []string) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM zone_adjacencies WHERE zone_id = ? OR adjacent_zone_id = ?`, zoneID, zoneID); err != nil {
+		return err
+	}
+	for _, adjacentZoneID := range adjacentZoneIDs {
+		if adjacentZoneID == zoneID {
+			continue
+		}
+		exists := false
+		if err := tx.GetContext(ctx, &exists, `SELECT EXISTS (SELECT 1 FROM zones WHERE id = ?)`, adjacentZoneID); err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("zone %s: %w", adjacentZoneID, sql.ErrNoRows)
+		}
+		if _, err := tx.ExecContext(
+			ctx,
+			`INSERT INTO zone_adjacencies (zone_id, adjacent_zone_id) VALUES (?, ?), (?, ?) ON CONFLICT DO NOTHING`,
+			zoneID, adjacentZoneID, adjacentZoneID, zoneID,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func selectAdminZones(ctx context.Context, q sqlx.QueryerContext) ([]adminZone, error) {
+	rows := []Zone{}
+	if err := sqlx.SelectContext(ctx, q, &rows, `SELECT * FROM zones ORDER BY id`); err != nil {
+		return nil, err
+	}
+	adjacencies := []ZoneAdjacency{}
+	if err := sqlx.SelectContext(ctx, q, &adjacencies, `SELECT * FROM zone_adjacencies ORDER BY zone_id, adjacent_zone_id`); err != nil {
+		return nil, err
+	}
+	adjacentZoneIDs := map[string][]string{}
+	for _, a := range adjacencies {
+		adjacentZoneIDs[a.ZoneID] = append(adjacentZoneIDs[a.ZoneID], a.AdjacentZoneID)
+	}
+
+	items := make([]adminZone, 0, len(rows))
+	for _, row := range rows {
+		polygon := []Coordinate{}
+		if err := json.Unmarshal([]byte(row.Polygon), &polygon); err != nil {
+			return nil, fmt.Errorf("failed to parse polygon of zone %s: %w", row.ID, err)
+		}
+		ids := adjacentZoneIDs[row.ID]
+		if ids == nil {
+			ids = []string{}
+		}
+		items = append(items, adminZone{
+			ID:              row.ID,
+			Name:            row.Name,
+			Polygon:         polygon,
+			FareRatePercent: row.FareRatePercent,
+			AdjacentZoneIDs: ids,
+		})
+	}
+	return items, nil
+}
+
+type adminGetCachesResponse struct {
+	Caches []CacheStats `json:"caches"`
+}
+
+// プロセス内キャッシュの件数とヒット率。インスタンスごとの値
+func adminGetCaches(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	_, span := tracer.Start(ctx, "adminGetCaches")
+	defer span.End()
+
+	writeJSON(w, http.StatusOK, &adminGetCachesResponse{Caches: getCacheStats()})
+}
+
+type adminUser struct {
+	ID             string        `json:"id"`
+	Username       string        `json:"username"`
+	FirstName      string        `json:"firstname"`
+	LastName       string        `json:"lastname"`
+	DateOfBirth    string        `json:"date_of_birth"`
+	InvitationCode string        `json:"invitation_code"`
+	Reputation     userStats     `json:"reputation"`
+	RideCount      int           `json:"ride_count"`
+	Coupons        []adminCoupon `json:"coupons"`
+	CreatedAt      int64         `json:"created_at"`
+	DeletedAt      *int64        `json:"deleted_at"`
+}
+
+type adminCoupon struct {
+	Code      string  `json:"code"`
+	Discount  int     `json:"discount"`
+	UsedBy    *string `json:"used_by"`
+	CreatedAt int64   `json:"created_at"`
+}
+
+func adminGetUser(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	_, span := tracer.Start(ctx, "adminGetUser")
+	defer span.End()
+
+	userID := r.PathValue("user_id")
+	admin, err := AdminFrom(ctx)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	user := &User{}
+	if err := tx.GetContext(ctx, user, `SELECT * FROM users WHERE id = ?`, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("user not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	stats, err := getUserStats(ctx, tx, user.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	rideCount := 0
+	if err := tx.GetContext(ctx, &rideCount, `SELECT COUNT(*) FROM rides WHERE user_id = ?`, user.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	coupons := []Coupon{}
+	if err := tx.SelectContext(ctx, &coupons, `SELECT * FROM coupons WHERE user_id = ? ORDER BY created_at`, user.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// 個人情報を見たことも記録する
+	if err := insertAdminAuditLog(ctx, tx, admin, "user.view", "user", user.ID, nil); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := &adminUser{
+		ID:             user.ID,
+		Username:       user.Username,
+		FirstName:      user.Firstname,
+		LastName:       user.Lastname,
+		DateOfBirth:    user.DateOfBirth,
+		InvitationCode: user.InvitationCode,
+		Reputation:     stats,
+		RideCount:      rideCount,
+		Coupons: lo.Map(coupons, func(c Coupon, _ int) adminCoupon {
+			return adminCoupon{Code: c.Code, Discount: c.Discount, UsedBy: c.UsedBy, CreatedAt: c.CreatedAt.UnixMilli()}
+		}),
+		CreatedAt: user.CreatedAt.UnixMilli(),
+	}
+	if user.DeletedAt.Valid {
+		res.DeletedAt = lo.ToPtr(user.DeletedAt.Time.UnixMilli())
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+type adminOwner struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	ChairIDs  []string `json:"chair_ids"`
+	CreatedAt int64    `json:"created_at"`
+}
+
+func adminGetOwner(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	_, span := tracer.Start(ctx, "adminGetOwner")
+	defer span.End()
+
+	ownerID := r.PathValue("owner_id")
+	admin, err := AdminFrom(ctx)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	owner := &Owner{}
+	if err := db.GetContext(ctx, owner, `SELECT * FROM owners WHERE id = ?`, ownerID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("owner not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	chairIDs := []string{}
+	if err := db.SelectContext(ctx, &chairIDs, `SELECT id FROM isu1.chairs WHERE owner_id = ? ORDER BY id`, owner.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := insertAdminAuditLog(ctx, db, admin, "owner.view", "owner", owner.ID, nil); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &adminOwner{
+		ID:        owner.ID,
+		Name:      owner.Name,
+		ChairIDs:  chairIDs,
+		CreatedAt: owner.CreatedAt.UnixMilli(),
+	})
+}
+
+type adminChair struct {
+	ID            string      `json:"id"`
+	OwnerID       string      `json:"owner_id"`
+	Name          string      `json:"name"`
+	Model         string      `json:"model"`
+	Active        bool        `json:"active"`
+	Vacant        bool        `json:"vacant"`
+	Stale         bool        `json:"stale"`
+	ActiveRideIDs []string    `json:"active_ride_ids"`
+	Location      *Coordinate `json:"location"`
+	CreatedAt     int64       `json:"created_at"`
+}
+
+func adminGetChair(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	_, span := tracer.Start(ctx, "adminGetChair")
+	defer span.End()
+
+	chairID := r.PathValue("chair_id")
+	admin, err := AdminFrom(ctx)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	chair := &Chair{}
+	if err := db.GetContext(ctx, chair, `SELECT * FROM isu1.chairs WHERE id = ?`, chairID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("chair not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	vacant := false
+	if err := db.GetContext(ctx, &vacant, `SELECT EXISTS (SELECT 1 FROM vacant_chair WHERE chair_id = ?)`, chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	stale, err := isChairStale(ctx, chair.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	activeRideIDs := []string{}
+	if err := db.SelectContext(ctx, &activeRideIDs, `SELECT id FROM rides WHERE chair_id = ? AND status NOT IN ('COMPLETED', 'CANCELED') ORDER BY id`, chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	var location *Coordinate
+	chairLocation := &ChairLocation{}
+	if err := db.GetContext(ctx, chairLocation, `SELECT * FROM isu1.chair_locations WHERE chair_id = ? ORDER BY created_at DESC LIMIT 1`, chair.ID); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	} else {
+		location = &Coordinate{Latitude: chairLocation.Latitude, Longitude: chairLocation.Longitude}
+	}
+	if err := insertAdminAuditLog(ctx, db, admin, "chair.view", "chair", chair.ID, nil); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &adminChair{
+		ID:            chair.ID,
+		OwnerID:       chair.OwnerID,
+		Name:          chair.Name,
+		Model:         chair.Model,
+		Active:        chair.IsActive,
+		Vacant:        vacant,
+		Stale:         stale,
+		ActiveRideIDs: activeRideIDs,
+		Location:      location,
+		CreatedAt:     chair.CreatedAt.UnixMilli(),
+	})
+}
+
+type adminRide struct {
+	ID                    string                `json:"id"`
+	UserID                string                `json:"user_id"`
+	ChairID               *string               `json:"chair_id"`
+	PickupCoordinate      Coordinate            `json:"pickup_coordinate"`
+	DestinationCoordinate Coordinate            `json:"destination_coordinate"`
+	Status                string                `json:"status"`
+	Evaluation            *int                  `json:"evaluation"`
+	Pooled                bool                  `json:"pooled"`
+	PooledWith            *string               `json:"pooled_with"`
+	Statuses              []adminRideStatus     `json:"statuses"`
+	Assignments           []adminRideAssignment `json:"assignments"`
+	CreatedAt             int64                 `json:"created_at"`
+	UpdatedAt             int64                 `json:"updated_at"`
+}
+
+type adminRideStatus struct {
+	Status    string `json:"status"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+type adminRideAssignment struct {
+	ChairID    string `json:"chair_id"`
+	Status     string `json:"status"`
+	AssignedAt int64  `json:"assigned_at"`
+}
+
+func adminGetRide(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	_, span := tracer.Start(ctx, "adminGetRide")
+	defer span.End()
+
+	rideID := r.PathValue("ride_id")
+	admin, err := AdminFrom(ctx)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	ride := &Ride{}
+	if err := db.GetContext(ctx, ride, `SELECT * FROM rides WHERE id = ?`, rideID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("ride not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	statuses := []RideStatus{}
+	if err := db.SelectContext(ctx, &statuses, `SELECT * FROM ride_statuses WHERE ride_id = ? ORDER BY created_at`, ride.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	assignments := []RideAssignment{}
+	if err := db.SelectContext(ctx, &assignments, `SELECT * FROM ride_assignments WHERE ride_id = ? ORDER BY assigned_at`, ride.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := insertAdminAuditLog(ctx, db, admin, "ride.view", "ride", ride.ID, nil); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newAdminRide(ride, statuses, assignments))
+}
+
+func newAdminRide(ride *Ride, statuses []RideStatus, assignments []RideAssignment) *adminRide {
+	res := &adminRide{
+		ID:                    ride.ID,
+		UserID:                ride.UserID,
+		PickupCoordinate:      Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude},
+		DestinationCoordinate: Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude},
+		Status:                ride.Status,
+		Evaluation:            ride.Evaluation,
+		Pooled:                ride.Pooled,
+		Statuses: lo.Map(statuses, func(s RideStatus, _ int) adminRideStatus {
+			return adminRideStatus{Status: s.Status, CreatedAt: s.CreatedAt.UnixMilli()}
+		}),
+		Assignments: lo.Map(assignments, func(a RideAssignment, _ int) adminRideAssignment {
+			return adminRideAssignment{ChairID: a.ChairID, Status: a.Status, AssignedAt: a.AssignedAt.UnixMilli()}
+		}),
+		CreatedAt: ride.CreatedAt.UnixMilli(),
+		UpdatedAt: ride.UpdatedAt.UnixMilli(),
+	}
+	if ride.ChairID.Valid {
+		res.ChairID = &ride.ChairID.String
+	}
+	if ride.PooledWith.Valid {
+		res.PooledWith = &ride.PooledWith.String
+	}
+	return res
+}
+
+type adminPostRideActionRequest struct {
+	Reason string `json:"reason" validate:"required,max=500"`
+}
+
+func adminPostRideComplete(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	_, span := tracer.Start(ctx, "adminPostRideComplete")
+	defer span.End()
+
+	finishRideByAdmin(w, r, "COMPLETED")
+}
+
+func adminPostRideCancel(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	_, span := tracer.Start(ctx, "adminPostRideCancel")
+	defer span.End()
+
+	finishRideByAdmin(w, r, "CANCELED")
+}
+
+// 進行中のまま止まったライドを運用者が完了・キャンセルにする。
+// 完了にしても決済はしない。キャンセルならライドに使ったクーポンは戻す
+func finishRideByAdmin(w http.ResponseWriter, r *http.Request, status string) {
+	ctx := r.Context()
+	rideID := r.PathValue("ride_id")
+
+	admin, err := AdminFrom(ctx)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	req := &adminPostRideActionRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	ride := &Ride{}
+	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE id = ? FOR UPDATE`, rideID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("ride not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if ride.Status == "COMPLETED" || ride.Status == "CANCELED" {
+		writeError(w, http.StatusConflict, fmt.Errorf("ride is already %s", ride.Status))
+		return
+	}
+	previousStatus := ride.Status
+
+	if _, err := resolveRideAssignment(ctx, tx, ride.ID, "REVOKED"); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := insertRideStatus(ctx, tx, ride.ID, status); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE rides SET updated_at = CURRENT_TIMESTAMP(6) WHERE id = ?`, ride.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	// 相乗りの相手はそのまま続ける。相乗りは途中で終わったので、両方の割引も取り消す
+	if ride.PooledWith.Valid {
+		if _, err := tx.ExecContext(ctx, `UPDATE rides SET pooled_with = NULL, pool_discount = 0 WHERE id IN (?, ?)`, ride.ID, ride.PooledWith.String); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	if status == "CANCELED" {
+		if _, err := tx.ExecContext(ctx, `UPDATE coupons SET used_by = NULL WHERE used_by = ?`, ride.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	deactivated := false
+	if ride.ChairID.Valid {
+		activeRideCount := 0
+		if err := tx.GetContext(ctx, &activeRideCount, `SELECT COUNT(*) FROM rides WHERE chair_id = ? AND status NOT IN ('COMPLETED', 'CANCELED')`, ride.ChairID.String); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if activeRideCount == 0 {
+			deactivated, err = releaseChair(ctx, tx, ride.ChairID.String)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+		}
+	}
+
+	action := "ride.complete"
+	if status == "CANCELED" {
+		action = "ride.cancel"
+	}
+	if err := insertAdminAuditLog(ctx, tx, admin, action, "ride", ride.ID, map[string]string{
+		"reason":          req.Reason,
+		"previous_status": previousStatus,
+	}); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if deactivated {
+		invalidateSubjectCache(ctx, sessionRoleChair, ride.ChairID.String)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type adminPostUserCouponRequest struct {
+	Code     string `json:"code" validate:"required,max=255"`
+	Discount int    `json:"discount" validate:"min=1"`
+	Reason   string `json:"reason" validate:"required,max=500"`
+}
+
+func adminPostUserCoupon(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	_, span := tracer.Start(ctx, "adminPostUserCoupon")
+	defer span.End()
+
+	userID := r.PathValue("user_id")
+	admin, err := AdminFrom(ctx)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	req := &adminPostUserCouponRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	exists := false
+	if err := tx.GetContext(ctx, &exists, `SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)`, userID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, errors.New("user not found"))
+		return
+	}
+	result, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO coupons (user_id, code, discount) VALUES (?, ?, ?) ON CONFLICT DO NOTHING`,
+		userID, req.Code, req.Discount,
+	)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if n == 0 {
+		writeError(w, http.StatusConflict, errors.New("the user already has this coupon"))
+		return
+	}
+	if err := insertAdminAuditLog(ctx, tx, admin, "coupon.grant", "user", userID, req); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+type adminGetMatchingResponse struct {
+	MatchingRides    int    `json:"matching_rides"`     // 椅子を待っているライド
+	OfferedRides     int    `json:"offered_rides"`      // 椅子にオファー中のライド
+	ScheduledRides   int    `json:"scheduled_rides"`    // マッチング開始前の予約
+	VacantChairs     int    `json:"vacant_chairs"`      // 割り当てられる空き椅子
+	StaleChairs      int64  `json:"stale_chairs"`       // 停止中とみなしている椅子
+	OldestMatchingAt *int64 `json:"oldest_matching_at"` // 最も長く待っているライドの依頼日時
+}
+
+// マッチング待ちの状況
+func adminGetMatching(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	_, span := tracer.Start(ctx, "adminGetMatching")
+	defer span.End()
+
+	type rideCounts struct {
+		Matching         int          `db:"matching"`
+		Offered          int          `db:"offered"`
+		Scheduled        int          `db:"scheduled"`
+		OldestMatchingAt sql.NullTime `db:"oldest_matching_at"`
+	}
+	counts := &rideCounts{}
+	if err := db.GetContext(ctx, counts, `
+SELECT
+  COUNT(*) FILTER (WHERE status = 'MATCHING' AND chair_id IS NULL) AS matching,
+  COUNT(*) FILTER (WHERE status = 'MATCHING' AND chair_id IS NOT NULL) AS offered,
+  COUNT(*) FILTER (WHERE status = 'SCHEDULED') AS scheduled,
+  MIN(created_at) FILTER (WHERE status = 'MATCHING' AND chair_id IS NULL) AS oldest_matching_at
+FROM rides
+WHERE status IN ('MATCHING', 'SCHEDULED')
+`); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	vacantChairs := 0
+	if err := db.GetContext(ctx, &vacantChairs, `SELECT COUNT(*) FROM vacant_chair`); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	staleChairs, err := rdb.HLen(ctx, chairStaleKey).Result()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := &adminGetMatchingResponse{
+		MatchingRides:  counts.Matching,
+		OfferedRides:   counts.Offered,
+		ScheduledRides: counts.Scheduled,
+		VacantChairs:   vacantChairs,
+		StaleChairs:    staleChairs,
+	}
+	if counts.OldestMatchingAt.Valid {
+		res.OldestMatchingAt = lo.ToPtr(counts.OldestMatchingAt.Time.UnixMilli())
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+type adminGetAuditLogsResponse struct {
+	AuditLogs []adminAuditLog `json:"audit_logs"`
+}
+
+type adminAuditLog struct {
+	ID         string          `json:"id"`
+	AdminID    string          `json:"admin_id"`
+	AdminName  string          `json:"admin_name"`
+	Action     string          `json:"action"`
+	TargetType string          `json:"target_type"`
+	TargetID   string          `json:"target_id"`
+	Detail     json.RawMessage `json:"detail"`
+	CreatedAt  int64           `json:"created_at"`
+}
+
+// 新しい順。target_type と target_id、admin_id で絞り込める
+func adminGetAuditLogs(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	_, span := tracer.Start(ctx, "adminGetAuditLogs")
+	defer span.End()
+
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed <= 0 || parsed > 1000 {
+			writeError(w, http.StatusBadRequest, errors.New("limit must be between 1 and 1000"))
+			return
+		}
+		limit = parsed
+	}
+	query := `SELECT * FROM admin_audit_logs WHERE TRUE`
+	args := []any{}
+	for _, name := range []string{"target_type", "target_id", "admin_id"} {
+		if v := r.URL.Query().Get(name); v != "" {
+			query += ` AND ` + name + ` = ?`
+			args = append(args, v)
+		}
+	}
+	query += ` ORDER BY id DESC LIMIT ?`
+	args = append(args, limit)
+
+	logs := []AdminAuditLog{}
+	if err := db.SelectContext(ctx, &logs, query, args...); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &adminGetAuditLogsResponse{
+		AuditLogs: lo.Map(logs, func(l AdminAuditLog, _ int) adminAuditLog {
+			return adminAuditLog{
+				ID:         l.ID,
+				AdminID:    l.AdminID,
+				AdminName:  l.AdminName,
+				Action:     l.Action,
+				TargetType: l.TargetType,
+				TargetID:   l.TargetID,
+				Detail:     json.RawMessage(l.Detail),
+				CreatedAt:  l.CreatedAt.UnixMilli(),
+			}
+		}),
+	})
+}
+
+type adminAdmin struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Role      string `json:"role"`
+	CreatedAt int64  `json:"created_at"`
+	RevokedAt *int64 `json:"revoked_at,omitempty"`
+}
+
+func newAdminAdmin(a *Admin) adminAdmin {
+	res := adminAdmin{ID: a.ID, Name: a.Name, Role: a.Role, CreatedAt: a.CreatedAt.UnixMilli()}
+	if a.RevokedAt.Valid {
+		res.RevokedAt = lo.ToPtr(a.RevokedAt.Time.UnixMilli())
+	}
+	return res
+}
+
+type adminGetAdminsResponse struct {
+	Admins []adminAdmin `json:"admins"`
+}
+
+func adminGetAdmins(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	_, span := tracer.Start(ctx, "adminGetAdmins")
+	defer span.End()
+
+	admins := []Admin{}
+	if err := db.SelectContext(ctx, &admins, `SELECT * FROM admins ORDER BY id`); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &adminGetAdminsResponse{
+		Admins: lo.Map(admins, func(a Admin, _ int) adminAdmin { return newAdminAdmin(&a) }),
+	})
+}
+
+type adminPostAdminsRequest struct {
+	Name string `json:"name" validate:"required,max=50"`
+	Role string `json:"role" validate:"required,oneof=viewer operator superuser"`
+}
+
+type adminPostAdminsResponse struct {
+	adminAdmin
+	Token string `json:"token"`
+}
+
+// トークンはこのレスポンスでしか返さない
+func adminPostAdmins(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	_, span := tracer.Start(ctx, "adminPostAdmins")
+	defer span.End()
+
+	admin, err := AdminFrom(ctx)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	req := &adminPostAdminsRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	created, token, err := createAdmin(ctx, tx, req.Name, req.Role)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := insertAdminAuditLog(ctx, tx, admin, "admin.create", "admin", created.ID, req); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, &adminPostAdminsResponse{
+		adminAdmin: newAdminAdmin(created),
+		Token:      token,
+	})
+}
+
+func adminDeleteAdmin(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	_, span := tracer.Start(ctx, "adminDeleteAdmin")
+	defer span.End()
+
+	adminID := r.PathValue("admin_id")
+	admin, err := AdminFrom(ctx)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+	if adminID == admin.ID {
+		writeError(w, http.StatusBadRequest, errors.New("cannot revoke yourself"))
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `UPDATE admins SET revoked_at = CURRENT_TIMESTAMP(6) WHERE id = ? AND revoked_at IS NULL`, adminID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if n == 0 {
+		writeError(w, http.StatusNotFound, errors.New("admin not found"))
+		return
+	}
+	if err := insertAdminAuditLog(ctx, tx, admin, "admin.revoke", "admin", adminID, nil); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
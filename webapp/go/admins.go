@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+	"github.com/samber/lo"
+)
+
+// 運用者は admins に登録した管理者のトークンを Authorization: Bearer で送って管理APIを使う。
+// 管理者のロールは viewer(参照のみ) < operator(ライドの操作・クーポンの付与・ゾーンの編集) < superuser(管理者の管理) で、
+// 上位のロールは下位のロールのAPIも使える。
+// 最初の管理者を登録するために、環境変数 ADMIN_TOKEN を送った場合は superuser として扱う。
+// 管理APIでの操作は admin_audit_logs に記録する
+const (
+	adminRoleViewer    = "viewer"
+	adminRoleOperator  = "operator"
+	adminRoleSuperuser = "superuser"
+)
+
+var adminRoles = []string{adminRoleViewer, adminRoleOperator, adminRoleSuperuser}
+
+// ADMIN_TOKEN で認証したときの管理者
+var bootstrapAdmin = &Admin{ID: "bootstrap", Name: "bootstrap", Role: adminRoleSuperuser}
+
+func (a *Admin) hasRole(role string) bool {
+	return lo.IndexOf(adminRoles, a.Role) >= lo.IndexOf(adminRoles, role)
+}
+
+// 新しい管理者を登録してトークンを返す。トークンはDBに残らない
+func createAdmin(ctx context.Context, tx *sqlx.Tx, name, role string) (*Admin, string, error) {
+	token := secureRandomStr(32)
+	admin := &Admin{
+		ID:        ulid.Make().String(),
+		Name:      name,
+		Role:      role,
+		TokenHash: hashSessionToken(token),
+		CreatedAt: time.Now(),
+	}
+	if _, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO admins (id, name, role, token_hash, created_at) VALUES (?, ?, ?, ?, ?)`,
+		admin.ID, admin.Name, admin.Role, admin.TokenHash, admin.CreatedAt,
+	); err != nil {
+		return nil, "", fmt.Errorf("failed to insert admin: %w", err)
+	}
+	return admin, token, nil
+}
+
+// トークンに対応する有効な管理者を返す。無ければ sql.ErrNoRows
+func getAdminByToken(ctx context.Context, token string) (*Admin, error) {
+	admin := &Admin{}
+	if err := db.GetContext(ctx, admin, `SELECT * FROM admins WHERE token_hash = ? AND revoked_at IS NULL`, hashSessionToken(token)); err != nil {
+		return nil, err
+	}
+	return admin, nil
+}
+
+// 操作と同じトランザクションで記録する。detail は JSON にして残す
+func insertAdminAuditLog(ctx context.Context, q sqlx.ExecerContext, admin *Admin, action, targetType, targetID string, detail any) error {
+	if admin == nil {
+		return errors.New("admin is required for audit log")
+	}
+	detailJSON, err := json.Marshal(detail)
+	if err != nil {
+		return err
+	}
+	if _, err := q.ExecContext(
+		ctx,
+		`INSERT INTO admin_audit_logs (id, admin_id, admin_name, action, target_type, target_id, detail) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		ulid.Make().String(), admin.ID, admin.Name, action, targetType, targetID, string(detailJSON),
+	); err != nil {
+		return fmt.Errorf("failed to insert admin audit log: %w", err)
+	}
+	return nil
+}
@@ -7,18 +7,21 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/isucon/isucon14/webapp/go/validate"
 	"github.com/jmoiron/sqlx"
 	"github.com/oklog/ulid/v2"
+	"github.com/samber/lo"
 )
 
 type appPostUsersRequest struct {
-	Username       string  `json:"username"`
-	FirstName      string  `json:"firstname"`
-	LastName       string  `json:"lastname"`
-	DateOfBirth    string  `json:"date_of_birth"`
-	InvitationCode *string `json:"invitation_code"`
+	Username       string  `json:"username" validate:"required,max=30"`
+	FirstName      string  `json:"firstname" validate:"required,max=30"`
+	LastName       string  `json:"lastname" validate:"required,max=30"`
+	DateOfBirth    string  `json:"date_of_birth" validate:"required,date"`
+	InvitationCode *string `json:"invitation_code" validate:"max=30"`
 }
 
 type appPostUsersResponse struct {
@@ -36,13 +39,8 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, err)
 		return
 	}
-	if req.Username == "" || req.FirstName == "" || req.LastName == "" || req.DateOfBirth == "" {
-		writeError(w, http.StatusBadRequest, errors.New("required fields(username, firstname, lastname, date_of_birth) are empty"))
-		return
-	}
 
 	userID := ulid.Make().String()
-	accessToken := secureRandomStr(32)
 	invitationCode := secureRandomStr(15)
 
 	tx, err := db.Beginx()
@@ -52,10 +50,16 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
+	token, err := createSession(ctx, tx, sessionRoleApp, userID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
 	_, err = tx.ExecContext(
 		ctx,
-		"INSERT INTO users (id, username, firstname, lastname, date_of_birth, access_token, invitation_code) VALUES (?, ?, ?, ?, ?, ?, ?)",
-		userID, req.Username, req.FirstName, req.LastName, req.DateOfBirth, accessToken, invitationCode,
+		"INSERT INTO users (id, username, firstname, lastname, date_of_birth, invitation_code) VALUES (?, ?, ?, ?, ?, ?)",
+		userID, req.Username, req.FirstName, req.LastName, req.DateOfBirth, invitationCode,
 	)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
@@ -127,11 +131,7 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Path:  "/",
-		Name:  "app_session",
-		Value: accessToken,
-	})
+	setSessionCookie(w, sessionRoleApp, token)
 
 	writeJSON(w, http.StatusCreated, &appPostUsersResponse{
 		ID:             userID,
@@ -139,8 +139,202 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+func appPostLogout(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	_, span := tracer.Start(ctx, "appPostLogout")
+	defer span.End()
+
+	logout(w, r, sessionRoleApp)
+}
+
+type appGetMeResponse struct {
+	ID             string `json:"id"`
+	Username       string `json:"username"`
+	FirstName      string `json:"firstname"`
+	LastName       string `json:"lastname"`
+	DateOfBirth    string `json:"date_of_birth"`
+	InvitationCode string `json:"invitation_code"`
+	CreatedAt      int64  `json:"created_at"`
+}
+
+func newAppGetMeResponse(user *User) *appGetMeResponse {
+	return &appGetMeResponse{
+		ID:             user.ID,
+		Username:       user.Username,
+		FirstName:      user.Firstname,
+		LastName:       user.Lastname,
+		DateOfBirth:    user.DateOfBirth,
+		InvitationCode: user.InvitationCode,
+		CreatedAt:      user.CreatedAt.UnixMilli(),
+	}
+}
+
+func appGetMe(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	_, span := tracer.Start(ctx, "appGetMe")
+	defer span.End()
+
+	user, err := UserFrom(ctx)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	// 認証のキャッシュは古いことがあるので引き直す
+	me := &User{}
+	if err := db.GetContext(ctx, me, `SELECT * FROM users WHERE id = ?`, user.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newAppGetMeResponse(me))
+}
+
+// 指定したものだけ変更する
+type appPatchMeRequest struct {
+	Username    *string `json:"username" validate:"min=1,max=30"`
+	FirstName   *string `json:"firstname" validate:"min=1,max=30"`
+	LastName    *string `json:"lastname" validate:"min=1,max=30"`
+	DateOfBirth *string `json:"date_of_birth" validate:"date"`
+}
+
+func appPatchMe(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	_, span := tracer.Start(ctx, "appPatchMe")
+	defer span.End()
+
+	user, err := UserFrom(ctx)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	req := &appPatchMeRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	if req.Username != nil {
+		taken := false
+		if err := tx.GetContext(ctx, &taken, `SELECT EXISTS (SELECT 1 FROM users WHERE username = ? AND id <> ?)`, *req.Username, user.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if taken {
+			writeError(w, http.StatusConflict, withErrorCode(errCodeUsernameTaken, errors.New("username is already taken")))
+			return
+		}
+	}
+
+	updated := &User{}
+	if err := tx.GetContext(
+		ctx,
+		updated,
+		`UPDATE users SET
+  username = COALESCE(?, username),
+  firstname = COALESCE(?, firstname),
+  lastname = COALESCE(?, lastname),
+  date_of_birth = COALESCE(CAST(? AS DATE), date_of_birth),
+  updated_at = CURRENT_TIMESTAMP(6)
+WHERE id = ?
+RETURNING *`,
+		req.Username, req.FirstName, req.LastName, req.DateOfBirth, user.ID,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	invalidateSubjectCache(ctx, sessionRoleApp, user.ID)
+
+	writeJSON(w, http.StatusOK, newAppGetMeResponse(updated))
+}
+
+// 退会する。ライドは残して個人情報を消す
+func appDeleteMe(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	_, span := tracer.Start(ctx, "appDeleteMe")
+	defer span.End()
+
+	user, err := UserFrom(ctx)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	if err := deleteUser(ctx, tx, user); err != nil {
+		if errors.Is(err, errUserHasActiveRides) {
+			writeError(w, http.StatusConflict, withErrorCode(errCodeActiveRides, err))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	invalidateSubjectCache(ctx, sessionRoleApp, user.ID)
+	clearSessionCookie(w, sessionRoleApp)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// 利用者に関するデータをまとめてダウンロードする
+func appGetMeExport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	_, span := tracer.Start(ctx, "appGetMeExport")
+	defer span.End()
+
+	user, err := UserFrom(ctx)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{ReadOnly: true, Isolation: sql.LevelRepeatableRead})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	me := &User{}
+	if err := tx.GetContext(ctx, me, `SELECT * FROM users WHERE id = ?`, user.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	export, err := selectUserExport(ctx, tx, me)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="user-%s.json"`, user.ID))
+	writeJSON(w, http.StatusOK, export)
+}
+
 type appPostPaymentMethodsRequest struct {
-	Token string `json:"token"`
+	Token string `json:"token" validate:"required,max=255"`
 }
 
 func appPostPaymentMethods(w http.ResponseWriter, r *http.Request) {
@@ -153,14 +347,14 @@ func appPostPaymentMethods(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, err)
 		return
 	}
-	if req.Token == "" {
-		writeError(w, http.StatusBadRequest, errors.New("token is required but was empty"))
+
+	user, err := UserFrom(ctx)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
 		return
 	}
 
-	user := ctx.Value("user").(*User)
-
-	_, err := db.ExecContext(
+	_, err = db.ExecContext(
 		ctx,
 		`INSERT INTO payment_tokens (user_id, token) VALUES (?, ?)`,
 		user.ID,
@@ -175,7 +369,8 @@ func appPostPaymentMethods(w http.ResponseWriter, r *http.Request) {
 }
 
 type getAppRidesResponse struct {
-	Rides []getAppRidesResponseItem `json:"rides"`
+	Rides      []getAppRidesResponseItem `json:"rides"`
+	NextCursor *string                   `json:"next_cursor"`
 }
 
 type getAppRidesResponseItem struct {
@@ -185,6 +380,7 @@ type getAppRidesResponseItem struct {
 	Chair                 getAppRidesResponseItemChair `json:"chair"`
 	Fare                  int                          `json:"fare"`
 	Evaluation            int                          `json:"evaluation"`
+	Status                string                       `json:"status"`
 	RequestedAt           int64                        `json:"requested_at"`
 	CompletedAt           int64                        `json:"completed_at"`
 }
@@ -196,92 +392,145 @@ type getAppRidesResponseItemChair struct {
 	Model string `json:"model"`
 }
 
+const (
+	appGetRidesDefaultLimit = 20
+	appGetRidesMaxLimit     = 100
+)
+
+var rideStatuses = []string{"SCHEDULED", "MATCHING", "ENROUTE", "PICKUP", "CARRYING", "ARRIVED", "COMPLETED", "CANCELED"}
+
+type rideWithDetail struct {
+	Ride
+	ChairName  sql.NullString `db:"chair_name"`
+	ChairModel sql.NullString `db:"chair_model"`
+	OwnerName  sql.NullString `db:"owner_name"`
+	Discount   int            `db:"discount"`
+}
+
+// GET /api/app/rides?cursor=<ride_id>&limit=&since=&until=&status=
+// cursor より前(ride_id降順)のライドを返す。status未指定時は従来通り COMPLETED のみ
 func appGetRides(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	_, span := tracer.Start(ctx, "appGetRides")
 	defer span.End()
 
-	user := ctx.Value("user").(*User)
+	user, err := UserFrom(ctx)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
 
-	tx, err := db.Beginx()
+	query := r.URL.Query()
+	limit := appGetRidesDefaultLimit
+	if query.Get("limit") != "" {
+		parsed, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || parsed < 1 || parsed > appGetRidesMaxLimit {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("limit must be between 1 and %d", appGetRidesMaxLimit))
+			return
+		}
+		limit = parsed
+	}
+	since, err := parseUnixMilliQuery(r, "since", time.Unix(0, 0))
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
-	defer tx.Rollback()
+	until, err := parseUnixMilliQuery(r, "until", time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	status := "COMPLETED"
+	if query.Get("status") != "" {
+		status = query.Get("status")
+		if !lo.Contains(rideStatuses, status) {
+			writeError(w, http.StatusBadRequest, errors.New("status is invalid"))
+			return
+		}
+	}
 
-	rides := []Ride{}
-	if err := tx.SelectContext(
+	conditions := []string{"rides.user_id = ?", "rides.created_at BETWEEN ? AND ?", "rides.status = ?"}
+	args := []any{user.ID, since, until.Add(999 * time.Microsecond), status}
+	if cursor := query.Get("cursor"); cursor != "" {
+		conditions = append(conditions, "rides.id < ?")
+		args = append(args, cursor)
+	}
+	args = append(args, limit+1)
+
+	rides := []rideWithDetail{}
+	if err := db.SelectContext(
 		ctx,
 		&rides,
-		`SELECT * FROM rides WHERE user_id = ? ORDER BY created_at DESC`,
-		user.ID,
+		`SELECT rides.*,
+  chairs.name AS chair_name,
+  chairs.model AS chair_model,
+  owners.name AS owner_name,
+  COALESCE(coupons.discount, 0) AS discount
+FROM rides
+  LEFT JOIN isu1.chairs ON chairs.id = rides.chair_id
+  LEFT JOIN owners ON owners.id = chairs.owner_id
+  LEFT JOIN coupons ON coupons.used_by = rides.id
+WHERE `+strings.Join(conditions, " AND ")+`
+ORDER BY rides.id DESC
+LIMIT ?`,
+		args...,
 	); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	items := []getAppRidesResponseItem{}
-	for _, ride := range rides {
-		status, err := getLatestRideStatus(ctx, tx, ride.ID)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-		if status != "COMPLETED" {
-			continue
-		}
+	var nextCursor *string
+	if len(rides) > limit {
+		rides = rides[:limit]
+		nextCursor = &rides[limit-1].ID
+	}
 
-		fare, err := calculateDiscountedFare(ctx, tx, user.ID, &ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
+	waypoints, err := getRidesWaypoints(ctx, db, lo.Map(rides, func(ride rideWithDetail, _ int) string { return ride.ID }))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
 
+	items := make([]getAppRidesResponseItem, 0, len(rides))
+	for _, ride := range rides {
 		item := getAppRidesResponseItem{
 			ID:                    ride.ID,
 			PickupCoordinate:      Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude},
 			DestinationCoordinate: Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude},
-			Fare:                  fare,
-			Evaluation:            *ride.Evaluation,
+			Fare:                  calculateRideFare(&ride.Ride, ride.Discount, waypoints[ride.ID]),
+			Status:                ride.Status,
 			RequestedAt:           ride.CreatedAt.UnixMilli(),
-			CompletedAt:           ride.UpdatedAt.UnixMilli(),
+			Chair: getAppRidesResponseItemChair{
+				ID:    ride.ChairID.String,
+				Owner: ride.OwnerName.String,
+				Name:  ride.ChairName.String,
+				Model: ride.ChairModel.String,
+			},
 		}
-
-		item.Chair = getAppRidesResponseItemChair{}
-
-		chair := &Chair{}
-		if err := tx.GetContext(ctx, chair, `SELECT * FROM isu1.chairs WHERE id = ?`, ride.ChairID); err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
+		if ride.Evaluation != nil {
+			item.Evaluation = *ride.Evaluation
 		}
-		item.Chair.ID = chair.ID
-		item.Chair.Name = chair.Name
-		item.Chair.Model = chair.Model
-
-		owner := &Owner{}
-		if err := tx.GetContext(ctx, owner, `SELECT * FROM owners WHERE id = ?`, chair.OwnerID); err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
+		if ride.Status == "COMPLETED" {
+			item.CompletedAt = ride.UpdatedAt.UnixMilli()
 		}
-		item.Chair.Owner = owner.Name
-
 		items = append(items, item)
 	}
 
-	if err := tx.Commit(); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
 	writeJSON(w, http.StatusOK, &getAppRidesResponse{
-		Rides: items,
+		Rides:      items,
+		NextCursor: nextCursor,
 	})
 }
 
 type appPostRidesRequest struct {
-	PickupCoordinate      *Coordinate `json:"pickup_coordinate"`
-	DestinationCoordinate *Coordinate `json:"destination_coordinate"`
+	PickupCoordinate      *Coordinate `json:"pickup_coordinate" validate:"required"`
+	DestinationCoordinate *Coordinate `json:"destination_coordinate" validate:"required"`
+	// 指定された場合は予約ライドになる(unix milli)
+	PickupAt *int64 `json:"pickup_at"`
+	// 配車位置と目的地の間に順に立ち寄る経由地(5個まで)
+	Waypoints []Coordinate `json:"waypoints" validate:"max=5"`
+	// 相乗りを許可する
+	Pooled bool `json:"pooled"`
 }
 
 type appPostRidesResponse struct {
@@ -289,21 +538,6 @@ type appPostRidesResponse struct {
 	Fare   int    `json:"fare"`
 }
 
-type executableGet interface {
-	Get(dest interface{}, query string, args ...interface{}) error
-	GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
-}
-
-func getLatestRideStatus(ctx context.Context, tx executableGet, rideID string) (string, error) {
-	_, span := tracer.Start(ctx, "getLatestRideStatus")
-	defer span.End()
-	status := ""
-	if err := tx.GetContext(ctx, &status, `SELECT status FROM ride_statuses WHERE ride_id = ? ORDER BY created_at DESC LIMIT 1`, rideID); err != nil {
-		return "", err
-	}
-	return status, nil
-}
-
 func appPostRides(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	_, span := tracer.Start(ctx, "appPostRides")
@@ -314,59 +548,81 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, err)
 		return
 	}
-	if req.PickupCoordinate == nil || req.DestinationCoordinate == nil {
-		writeError(w, http.StatusBadRequest, errors.New("required fields(pickup_coordinate, destination_coordinate) are empty"))
+	if req.Pooled && len(req.Waypoints) > 0 {
+		writeError(w, http.StatusBadRequest, errors.New("pooled rides cannot have waypoints"))
+		return
+	}
+	if err := zones.checkServiceArea(append([]Coordinate{*req.PickupCoordinate, *req.DestinationCoordinate}, req.Waypoints...)...); err != nil {
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
 
-	user := ctx.Value("user").(*User)
-	rideID := ulid.Make().String()
+	var pickupAt *time.Time
+	if req.PickupAt != nil {
+		t := time.UnixMilli(*req.PickupAt)
+		if err := validateScheduledPickupAt(t, time.Now()); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		pickupAt = &t
+	}
 
-	tx, err := db.Beginx()
+	user, err := UserFrom(ctx)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
+		writeError(w, http.StatusUnauthorized, err)
 		return
 	}
-	defer tx.Rollback()
+	rideID := ulid.Make().String()
 
-	rides := []Ride{}
-	if err := tx.SelectContext(ctx, &rides, `SELECT * FROM rides WHERE user_id = ?`, user.ID); err != nil {
+	tx, err := db.Beginx()
+	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	defer tx.Rollback()
 
-	continuingRideCount := 0
-	for _, ride := range rides {
-		status, err := getLatestRideStatus(ctx, tx, ride.ID)
-		if err != nil {
+	initialStatus := "MATCHING"
+	if pickupAt != nil {
+		// 予約は進行中のライドがあっても複数持てる
+		initialStatus = "SCHEDULED"
+		scheduledRideCount := 0
+		if err := tx.GetContext(ctx, &scheduledRideCount, `SELECT COUNT(*) FROM rides WHERE user_id = ? AND status = 'SCHEDULED'`, user.ID); err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
-		if status != "COMPLETED" {
-			continuingRideCount++
+		if scheduledRideCount >= maxScheduledRidesPerUser {
+			writeError(w, http.StatusConflict, errors.New("too many scheduled rides"))
+			return
+		}
+	} else {
+		continuingRideCount := 0
+		if err := tx.GetContext(ctx, &continuingRideCount, `SELECT COUNT(*) FROM rides WHERE user_id = ? AND status NOT IN ('COMPLETED', 'CANCELED', 'SCHEDULED')`, user.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
 		}
-	}
 
-	if continuingRideCount > 0 {
-		writeError(w, http.StatusConflict, errors.New("ride already exists"))
-		return
+		if continuingRideCount > 0 {
+			writeError(w, http.StatusConflict, errors.New("ride already exists"))
+			return
+		}
 	}
 
 	if _, err := tx.ExecContext(
 		ctx,
-		`INSERT INTO rides (id, user_id, pickup_latitude, pickup_longitude, destination_latitude, destination_longitude)
-				  VALUES (?, ?, ?, ?, ?, ?)`,
-		rideID, user.ID, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude,
+		`INSERT INTO rides (id, user_id, pickup_latitude, pickup_longitude, destination_latitude, destination_longitude, pickup_at, pooled, fare_rate_percent)
+				  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		rideID, user.ID, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude, pickupAt, req.Pooled, zones.fareRatePercent(*req.PickupCoordinate),
 	); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	if _, err := tx.ExecContext(
-		ctx,
-		`INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)`,
-		ulid.Make().String(), rideID, "MATCHING",
-	); err != nil {
+	if err := insertRideStatus(ctx, tx, rideID, initialStatus); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := insertRideWaypoints(ctx, tx, rideID, req.Waypoints); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
@@ -455,8 +711,9 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 }
 
 type appPostRidesEstimatedFareRequest struct {
-	PickupCoordinate      *Coordinate `json:"pickup_coordinate"`
-	DestinationCoordinate *Coordinate `json:"destination_coordinate"`
+	PickupCoordinate      *Coordinate  `json:"pickup_coordinate" validate:"required"`
+	DestinationCoordinate *Coordinate  `json:"destination_coordinate" validate:"required"`
+	Waypoints             []Coordinate `json:"waypoints" validate:"max=5"`
 }
 
 type appPostRidesEstimatedFareResponse struct {
@@ -474,12 +731,16 @@ func appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, err)
 		return
 	}
-	if req.PickupCoordinate == nil || req.DestinationCoordinate == nil {
-		writeError(w, http.StatusBadRequest, errors.New("required fields(pickup_coordinate, destination_coordinate) are empty"))
+	if err := zones.checkServiceArea(append([]Coordinate{*req.PickupCoordinate, *req.DestinationCoordinate}, req.Waypoints...)...); err != nil {
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
 
-	user := ctx.Value("user").(*User)
+	user, err := UserFrom(ctx)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
 
 	tx, err := db.Beginx()
 	if err != nil {
@@ -488,7 +749,7 @@ func appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
-	discounted, err := calculateDiscountedFare(ctx, tx, user.ID, nil, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
+	discounted, err := calculateDiscountedFare(ctx, tx, user.ID, nil, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude, req.Waypoints...)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
@@ -501,7 +762,7 @@ func appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Request) {
 
 	writeJSON(w, http.StatusOK, &appPostRidesEstimatedFareResponse{
 		Fare:     discounted,
-		Discount: calculateFare(req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude) - discounted,
+		Discount: calculateFare(req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude, req.Waypoints...) - discounted,
 	})
 }
 
@@ -518,7 +779,9 @@ func abs(a int) int {
 }
 
 type appPostRideEvaluationRequest struct {
-	Evaluation int `json:"evaluation"`
+	Evaluation int      `json:"evaluation" validate:"min=1,max=5"`
+	Comment    *string  `json:"comment"`
+	Tags       []string `json:"tags"`
 }
 
 type appPostRideEvaluationResponse struct {
@@ -537,8 +800,8 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, err)
 		return
 	}
-	if req.Evaluation < 1 || req.Evaluation > 5 {
-		writeError(w, http.StatusBadRequest, errors.New("evaluation must be between 1 and 5"))
+	if err := validateEvaluationDetail(req.Comment, req.Tags); err != nil {
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
 
@@ -558,13 +821,7 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-	status, err := getLatestRideStatus(ctx, tx, ride.ID)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
-	if status != "ARRIVED" {
+	if ride.Status != "ARRIVED" {
 		writeError(w, http.StatusBadRequest, errors.New("not arrived yet"))
 		return
 	}
@@ -585,11 +842,12 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = tx.ExecContext(
-		ctx,
-		`INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)`,
-		ulid.Make().String(), rideID, "COMPLETED")
-	if err != nil {
+	if err := insertEvaluationDetail(ctx, tx, ride, req.Comment, req.Tags); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := insertRideStatus(ctx, tx, rideID, "COMPLETED"); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
@@ -666,6 +924,7 @@ type appGetNotificationResponseData struct {
 	RideID                string                           `json:"ride_id"`
 	PickupCoordinate      Coordinate                       `json:"pickup_coordinate"`
 	DestinationCoordinate Coordinate                       `json:"destination_coordinate"`
+	NextWaypoint          *Coordinate                      `json:"next_waypoint,omitempty"`
 	Fare                  int                              `json:"fare"`
 	Status                string                           `json:"status"`
 	Chair                 *appGetNotificationResponseChair `json:"chair,omitempty"`
@@ -690,7 +949,11 @@ func appGetNotification(w http.ResponseWriter, r *http.Request) {
 	_, span := tracer.Start(ctx, "appGetNotification")
 	defer span.End()
 
-	user := ctx.Value("user").(*User)
+	user, err := UserFrom(ctx)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
 
 	tx, err := db.Beginx()
 	if err != nil {
@@ -699,8 +962,15 @@ func appGetNotification(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
+	// 進行中のライドがあればそれを、無ければ最後に評価したライドを返す。
+	// 予約から移ったライドは作成日時が古いので、作成日時の順では選べない。
+	// 管理者が取り消したライドは、取り消しを通知するまで進行中として扱う
 	ride := &Ride{}
-	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE user_id = ? ORDER BY created_at DESC LIMIT 1`, user.ID); err != nil {
+	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides
+WHERE user_id = ?
+  AND status <> 'SCHEDULED'
+  AND (status <> 'CANCELED' OR EXISTS (SELECT 1 FROM ride_statuses WHERE ride_id = rides.id AND app_sent_at IS NULL))
+ORDER BY status = 'COMPLETED', updated_at DESC LIMIT 1`, user.ID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			writeJSON(w, http.StatusOK, &appGetNotificationResponse{
 				RetryAfterMs: 30,
@@ -715,11 +985,7 @@ func appGetNotification(w http.ResponseWriter, r *http.Request) {
 	status := ""
 	if err := tx.GetContext(ctx, &yetSentRideStatus, `SELECT * FROM ride_statuses WHERE ride_id = ? AND app_sent_at IS NULL ORDER BY created_at ASC LIMIT 1`, ride.ID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			status, err = getLatestRideStatus(ctx, tx, ride.ID)
-			if err != nil {
-				writeError(w, http.StatusInternalServerError, err)
-				return
-			}
+			status = ride.Status
 		} else {
 			writeError(w, http.StatusInternalServerError, err)
 			return
@@ -734,6 +1000,12 @@ func appGetNotification(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	nextWaypoint, err := getNextRideWaypoint(ctx, tx, ride.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
 	response := &appGetNotificationResponse{
 		Data: &appGetNotificationResponseData{
 			RideID: ride.ID,
@@ -745,10 +1017,11 @@ func appGetNotification(w http.ResponseWriter, r *http.Request) {
 				Latitude:  ride.DestinationLatitude,
 				Longitude: ride.DestinationLongitude,
 			},
-			Fare:      fare,
-			Status:    status,
-			CreatedAt: ride.CreatedAt.UnixMilli(),
-			UpdateAt:  ride.UpdatedAt.UnixMilli(),
+			NextWaypoint: nextWaypoint.coordinate(),
+			Fare:         fare,
+			Status:       status,
+			CreatedAt:    ride.CreatedAt.UnixMilli(),
+			UpdateAt:     ride.UpdatedAt.UnixMilli(),
 		},
 		RetryAfterMs: 30,
 	}
@@ -847,6 +1120,11 @@ type appGetNearbyChairsResponseChair struct {
 	CurrentCoordinate Coordinate `json:"current_coordinate"`
 }
 
+type appGetNearbyChairsQuery struct {
+	Coordinate
+	Distance int `json:"distance" validate:"min=1,max=1000"`
+}
+
 func appGetNearbyChairs(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	_, span := tracer.Start(ctx, "appGetNearbyChairs")
@@ -882,6 +1160,10 @@ func appGetNearbyChairs(w http.ResponseWriter, r *http.Request) {
 	}
 
 	coordinate := Coordinate{Latitude: lat, Longitude: lon}
+	if err := validate.Struct(&appGetNearbyChairsQuery{Coordinate: coordinate, Distance: distance}); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
 
 	tx, err := db.Beginx()
 	if err != nil {
@@ -907,26 +1189,13 @@ func appGetNearbyChairs(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 
-		rides := []*Ride{}
-		if err := tx.SelectContext(ctx, &rides, `SELECT * FROM rides WHERE chair_id = ? ORDER BY created_at DESC`, chair.ID); err != nil {
+		// 過去にライドが存在し、かつ、それが完了していない場合はスキップ
+		continuingRideCount := 0
+		if err := tx.GetContext(ctx, &continuingRideCount, `SELECT COUNT(*) FROM rides WHERE chair_id = ? AND status NOT IN ('COMPLETED', 'CANCELED')`, chair.ID); err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
-
-		skip := false
-		for _, ride := range rides {
-			// 過去にライドが存在し、かつ、それが完了していない場合はスキップ
-			status, err := getLatestRideStatus(ctx, tx, ride.ID)
-			if err != nil {
-				writeError(w, http.StatusInternalServerError, err)
-				return
-			}
-			if status != "COMPLETED" {
-				skip = true
-				break
-			}
-		}
-		if skip {
+		if continuingRideCount > 0 {
 			continue
 		}
 
@@ -976,53 +1245,203 @@ func appGetNearbyChairs(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func calculateFare(pickupLatitude, pickupLongitude, destLatitude, destLongitude int) int {
-	meteredFare := farePerDistance * calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude)
-	return initialFare + meteredFare
-}
-
-func calculateDiscountedFare(ctx context.Context, tx *sqlx.Tx, userID string, ride *Ride, pickupLatitude, pickupLongitude, destLatitude, destLongitude int) (int, error) {
-	_, span := tracer.Start(ctx, "calculateDiscountedFare")
+func appGetRideRoute(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	_, span := tracer.Start(ctx, "appGetRideRoute")
 	defer span.End()
 
-	var coupon Coupon
-	discount := 0
-	if ride != nil {
-		destLatitude = ride.DestinationLatitude
-		destLongitude = ride.DestinationLongitude
-		pickupLatitude = ride.PickupLatitude
-		pickupLongitude = ride.PickupLongitude
-
-		// すでにクーポンが紐づいているならそれの割引額を参照
-		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE used_by = ?", ride.ID); err != nil {
-			if !errors.Is(err, sql.ErrNoRows) {
-				return 0, err
-			}
-		} else {
-			discount = coupon.Discount
+	rideID := r.PathValue("ride_id")
+
+	user, err := UserFrom(ctx)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	ride := &Ride{}
+	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE id = ?`, rideID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("ride not found"))
+			return
 		}
-	} else {
-		// 初回利用クーポンを最優先で使う
-		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND code = 'CP_NEW2024' AND used_by IS NULL", userID); err != nil {
-			if !errors.Is(err, sql.ErrNoRows) {
-				return 0, err
-			}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if ride.UserID != user.ID {
+		writeError(w, http.StatusNotFound, errors.New("ride not found"))
+		return
+	}
 
-			// 無いなら他のクーポンを付与された順番に使う
-			if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at LIMIT 1", userID); err != nil {
-				if !errors.Is(err, sql.ErrNoRows) {
-					return 0, err
-				}
-			} else {
-				discount = coupon.Discount
+	// 椅子が向かい始めて(ENROUTE)から目的地に着く(ARRIVED)までの区間を経路とする
+	statuses := []RideStatus{}
+	if err := tx.SelectContext(ctx, &statuses, `SELECT * FROM ride_statuses WHERE ride_id = ? AND status IN ('ENROUTE', 'ARRIVED') ORDER BY created_at`, ride.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	var enrouteAt, arrivedAt *time.Time
+	for _, s := range statuses {
+		switch s.Status {
+		case "ENROUTE":
+			if enrouteAt == nil {
+				enrouteAt = &s.CreatedAt
 			}
-		} else {
-			discount = coupon.Discount
+		case "ARRIVED":
+			arrivedAt = &s.CreatedAt
+		}
+	}
+
+	locations := []ChairLocation{}
+	if ride.ChairID.Valid && enrouteAt != nil {
+		until := time.Now()
+		if arrivedAt != nil {
+			until = *arrivedAt
+		}
+		locations, err = selectChairTrail(ctx, tx, ride.ChairID.String, *enrouteAt, until)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeChairTrail(w, r, ride.ChairID.String, locations, map[string]any{"ride_id": ride.ID})
+}
+
+type appGetBookingsResponse struct {
+	Bookings []appGetBookingsResponseItem `json:"bookings"`
+}
+
+type appGetBookingsResponseItem struct {
+	RideID                string     `json:"ride_id"`
+	PickupCoordinate      Coordinate `json:"pickup_coordinate"`
+	DestinationCoordinate Coordinate `json:"destination_coordinate"`
+	Fare                  int        `json:"fare"`
+	PickupAt              int64      `json:"pickup_at"`
+	RequestedAt           int64      `json:"requested_at"`
+}
+
+func appGetBookings(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	_, span := tracer.Start(ctx, "appGetBookings")
+	defer span.End()
+
+	user, err := UserFrom(ctx)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	type booking struct {
+		Ride
+		Discount int `db:"discount"`
+	}
+	bookings := []booking{}
+	if err := db.SelectContext(
+		ctx,
+		&bookings,
+		`SELECT rides.*, COALESCE(coupons.discount, 0) AS discount
+FROM rides
+  LEFT JOIN coupons ON coupons.used_by = rides.id
+WHERE rides.user_id = ? AND rides.status = 'SCHEDULED'
+ORDER BY rides.pickup_at`,
+		user.ID,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	waypoints, err := getRidesWaypoints(ctx, db, lo.Map(bookings, func(b booking, _ int) string { return b.ID }))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	items := make([]appGetBookingsResponseItem, 0, len(bookings))
+	for _, b := range bookings {
+		items = append(items, appGetBookingsResponseItem{
+			RideID:                b.ID,
+			PickupCoordinate:      Coordinate{Latitude: b.PickupLatitude, Longitude: b.PickupLongitude},
+			DestinationCoordinate: Coordinate{Latitude: b.DestinationLatitude, Longitude: b.DestinationLongitude},
+			Fare:                  calculateRideFare(&b.Ride, b.Discount, waypoints[b.ID]),
+			PickupAt:              b.PickupAt.Time.UnixMilli(),
+			RequestedAt:           b.CreatedAt.UnixMilli(),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, &appGetBookingsResponse{
+		Bookings: items,
+	})
+}
+
+func appDeleteBooking(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	_, span := tracer.Start(ctx, "appDeleteBooking")
+	defer span.End()
+
+	rideID := r.PathValue("ride_id")
+
+	user, err := UserFrom(ctx)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	ride := &Ride{}
+	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE id = ? FOR UPDATE`, rideID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("booking not found"))
+			return
 		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if ride.UserID != user.ID || !ride.PickupAt.Valid {
+		writeError(w, http.StatusNotFound, errors.New("booking not found"))
+		return
+	}
+	// マッチングが始まった予約は通常のライドとして扱う
+	if ride.Status != "SCHEDULED" {
+		writeError(w, http.StatusConflict, errors.New("booking can no longer be canceled"))
+		return
+	}
+
+	if err := insertRideStatus(ctx, tx, ride.ID, "CANCELED"); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	// 利用者が自分で取り消したので通知しない
+	if _, err := tx.ExecContext(ctx, `UPDATE ride_statuses SET app_sent_at = CURRENT_TIMESTAMP(6) WHERE ride_id = ? AND app_sent_at IS NULL`, ride.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	// 予約に使ったクーポンは戻す
+	if _, err := tx.ExecContext(ctx, `UPDATE coupons SET used_by = NULL WHERE used_by = ?`, ride.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
 	}
 
-	meteredFare := farePerDistance * calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude)
-	discountedMeteredFare := max(meteredFare-discount, 0)
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
 
-	return initialFare + discountedMeteredFare, nil
+	w.WriteHeader(http.StatusNoContent)
 }
@@ -0,0 +1,31 @@
+// Package auth は認証ミドルウェアが確かめた利用者・オーナー・椅子などをリクエストのコンテキストに型付きで出し入れする。
+// キーは型ごとに別の非公開の型なので、文字列のキーのように他のパッケージと衝突したり取り違えたりしない。
+//
+// User や Chair などの型は DB のモデルとして main パッケージにあり、auth から main は import できないので、
+// UserFrom・ChairFrom などの型ごとの関数は main の middlewares.go で From を包んで定義する
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// 認証ミドルウェアを通っていないリクエストで取り出そうとしたときのエラー
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+type key[T any] struct{}
+
+func With[T any](ctx context.Context, v *T) context.Context {
+	return context.WithValue(ctx, key[T]{}, v)
+}
+
+// コンテキストに入っていなければ ErrUnauthenticated を返す
+func From[T any](ctx context.Context) (*T, error) {
+	v, ok := ctx.Value(key[T]{}).(*T)
+	if !ok || v == nil {
+		var zero T
+		return nil, fmt.Errorf("%w: %T is not in context", ErrUnauthenticated, zero)
+	}
+	return v, nil
+}
@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+type user struct{ id string }
+
+type chair struct{ id string }
+
+func TestWithFrom(t *testing.T) {
+	ctx := With(context.Background(), &user{id: "u"})
+	ctx = With(ctx, &chair{id: "c"})
+
+	u, err := From[user](ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.id != "u" {
+		t.Errorf("user id = %s, want u", u.id)
+	}
+	c, err := From[chair](ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.id != "c" {
+		t.Errorf("chair id = %s, want c", c.id)
+	}
+}
+
+func TestFromUnauthenticated(t *testing.T) {
+	tests := []struct {
+		name string
+		ctx  context.Context
+	}{
+		{name: "empty", ctx: context.Background()},
+		{name: "other type", ctx: With(context.Background(), &chair{id: "c"})},
+		{name: "nil", ctx: With[user](context.Background(), nil)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := From[user](tt.ctx)
+			if u != nil {
+				t.Errorf("got %v, want nil", u)
+			}
+			if !errors.Is(err, ErrUnauthenticated) {
+				t.Fatalf("err = %v, want ErrUnauthenticated", err)
+			}
+			if want := "unauthenticated: auth.user is not in context"; err.Error() != want {
+				t.Errorf("err = %q, want %q", err, want)
+			}
+		})
+	}
+}
@@ -1,60 +1,305 @@
 package main
 
-import "sync"
+import (
+	"container/list"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"golang.org/x/sync/singleflight"
+)
+
+// プロセス内のキャッシュ。capacity を超えたら最も長く使われていないものから捨て、ttl を過ぎたものは無いものとして扱う。
+// どちらも指定しなければ無制限。名前を付けたキャッシュはヒット数などを getCacheStats で見られる。
+// GetOrLoad で取得すると同じキーの取得は同時に1回しか走らず、見つからなかったという結果も negativeTTL の間だけ覚えておける
 type cache[K comparable, V any] struct {
-	sync.RWMutex
-	items map[K]V
+	sync.Mutex
+	name        string
+	capacity    int
+	ttl         time.Duration
+	negativeTTL time.Duration
+	isNegative  func(error) bool
+	items       map[K]*list.Element
+	order       *list.List // 先頭ほど最近使われた
+	group       singleflight.Group
+
+	hits         atomic.Int64
+	negativeHits atomic.Int64
+	misses       atomic.Int64
+	evictions    atomic.Int64
+	sharedLoads  atomic.Int64
+}
+
+// err があれば見つからなかったという結果
+type cacheEntry[K comparable, V any] struct {
+	key    K
+	value  V
+	err    error
+	expire time.Time
+}
+
+type cacheOptions struct {
+	name        string
+	capacity    int
+	ttl         time.Duration
+	negativeTTL time.Duration
+	isNegative  func(error) bool
+}
+
+type CacheOption func(*cacheOptions)
+
+func WithCacheName(name string) CacheOption {
+	return func(o *cacheOptions) { o.name = name }
 }
 
-func NewCache[K comparable, V any]() *cache[K, V] {
-	m := make(map[K]V)
+func WithCacheCapacity(capacity int) CacheOption {
+	return func(o *cacheOptions) { o.capacity = capacity }
+}
+
+func WithCacheTTL(ttl time.Duration) CacheOption {
+	return func(o *cacheOptions) { o.ttl = ttl }
+}
+
+// GetOrLoad の load が isNegative を満たすエラーを返したら、ttl の間は load せずにそのエラーを返す
+func WithCacheNegative(ttl time.Duration, isNegative func(error) bool) CacheOption {
+	return func(o *cacheOptions) {
+		o.negativeTTL = ttl
+		o.isNegative = isNegative
+	}
+}
+
+func NewCache[K comparable, V any](opts ...CacheOption) *cache[K, V] {
+	o := cacheOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
 	c := &cache[K, V]{
-		items: m,
+		name:        o.name,
+		capacity:    o.capacity,
+		ttl:         o.ttl,
+		negativeTTL: o.negativeTTL,
+		isNegative:  o.isNegative,
+		items:       make(map[K]*list.Element),
+		order:       list.New(),
+	}
+	if c.name != "" {
+		registerCache(c)
 	}
 	return c
 }
 
+func (c *cache[K, V]) expired(e *cacheEntry[K, V], now time.Time) bool {
+	return (c.ttl > 0 || e.err != nil) && now.After(e.expire)
+}
+
+func (c *cache[K, V]) removeElement(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.items, el.Value.(*cacheEntry[K, V]).key)
+}
+
 func (c *cache[K, V]) Set(key K, value V) {
+	c.set(key, value, nil, time.Now().Add(c.ttl))
+}
+
+func (c *cache[K, V]) set(key K, value V, err error, expire time.Time) {
 	c.Lock()
-	c.items[key] = value
-	c.Unlock()
+	defer c.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*cacheEntry[K, V])
+		e.value = value
+		e.err = err
+		e.expire = expire
+		c.order.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.order.PushFront(&cacheEntry[K, V]{key: key, value: value, err: err, expire: expire})
+	if c.capacity > 0 && c.order.Len() > c.capacity {
+		c.removeElement(c.order.Back())
+		c.evictions.Add(1)
+	}
+}
+
+// 見つからなかったという結果が入っていれば、そのエラーを返す
+func (c *cache[K, V]) lookup(key K) (V, error, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	var zero V
+	el, ok := c.items[key]
+	if !ok {
+		c.misses.Add(1)
+		return zero, nil, false
+	}
+	e := el.Value.(*cacheEntry[K, V])
+	if c.expired(e, time.Now()) {
+		c.removeElement(el)
+		c.misses.Add(1)
+		return zero, nil, false
+	}
+	c.order.MoveToFront(el)
+	if e.err != nil {
+		c.negativeHits.Add(1)
+		return zero, e.err, true
+	}
+	c.hits.Add(1)
+	return e.value, nil, true
 }
 
 func (c *cache[K, V]) Get(key K) (V, bool) {
-	c.RLock()
-	v, found := c.items[key]
-	c.RUnlock()
-	return v, found
+	v, err, ok := c.lookup(key)
+	if !ok || err != nil {
+		var zero V
+		return zero, false
+	}
+	return v, true
 }
 
+// キャッシュに無ければ load で取得して入れる
+func (c *cache[K, V]) GetOrLoad(key K, load func() (V, error)) (V, error) {
+	if v, err, ok := c.lookup(key); ok {
+		return v, err
+	}
+	res, err, shared := c.group.Do(fmt.Sprint(key), func() (any, error) {
+		v, err := load()
+		if err != nil {
+			if c.negativeTTL > 0 && c.isNegative(err) {
+				c.set(key, v, err, time.Now().Add(c.negativeTTL))
+			}
+			return v, err
+		}
+		c.Set(key, v)
+		return v, nil
+	})
+	if shared {
+		c.sharedLoads.Add(1)
+	}
+	if err != nil {
+		var zero V
+		return zero, err
+	}
+	return res.(V), nil
+}
+
+// 期限切れのものを除いたコピーを返す
 func (c *cache[K, V]) GetAll() map[K]V {
-	c.RLock()
-	v := c.items
-	c.RUnlock()
-	return v
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	res := make(map[K]V, len(c.items))
+	for k, el := range c.items {
+		e := el.Value.(*cacheEntry[K, V])
+		if e.err != nil || c.expired(e, now) {
+			continue
+		}
+		res[k] = e.value
+	}
+	return res
 }
 
 func (c *cache[K, V]) Del(key K) {
 	c.Lock()
-	delete(c.items, key)
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
 	c.Unlock()
 }
 
+// f が true を返したものを消して、消した数を返す
+func (c *cache[K, V]) DelFunc(f func(K, V) bool) int {
+	c.Lock()
+	defer c.Unlock()
+
+	n := 0
+	for el := c.order.Front(); el != nil; {
+		next := el.Next()
+		e := el.Value.(*cacheEntry[K, V])
+		if e.err == nil && f(e.key, e.value) {
+			c.removeElement(el)
+			n++
+		}
+		el = next
+	}
+	return n
+}
+
 func (c *cache[K, V]) DelAll() {
 	c.Lock()
-	c.items = make(map[K]V)
+	c.items = make(map[K]*list.Element)
+	c.order.Init()
 	c.Unlock()
 }
 
 func (c *cache[K, V]) Keys() []K {
-	c.RLock()
-	res := make([]K, len(c.items))
-	i := 0
-	for k, _ := range c.items {
-		res[i] = k
-		i++
-	}
-	c.RUnlock()
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	res := make([]K, 0, len(c.items))
+	for k, el := range c.items {
+		if e := el.Value.(*cacheEntry[K, V]); e.err != nil || c.expired(e, now) {
+			continue
+		}
+		res = append(res, k)
+	}
 	return res
 }
+
+type CacheStats struct {
+	Name         string  `json:"name"`
+	Size         int     `json:"size"`
+	Capacity     int     `json:"capacity"`
+	Hits         int64   `json:"hits"`
+	NegativeHits int64   `json:"negative_hits"`
+	Misses       int64   `json:"misses"`
+	Evictions    int64   `json:"evictions"`
+	SharedLoads  int64   `json:"shared_loads"` // 同時の取得がまとめられた呼び出しの数
+	HitRate      float64 `json:"hit_rate"`
+}
+
+func (c *cache[K, V]) Stats() CacheStats {
+	c.Lock()
+	size := len(c.items)
+	c.Unlock()
+
+	s := CacheStats{
+		Name:         c.name,
+		Size:         size,
+		Capacity:     c.capacity,
+		Hits:         c.hits.Load(),
+		NegativeHits: c.negativeHits.Load(),
+		Misses:       c.misses.Load(),
+		Evictions:    c.evictions.Load(),
+		SharedLoads:  c.sharedLoads.Load(),
+	}
+	if total := s.Hits + s.NegativeHits + s.Misses; total > 0 {
+		s.HitRate = float64(s.Hits+s.NegativeHits) / float64(total)
+	}
+	return s
+}
+
+var (
+	cacheRegistryMu sync.Mutex
+	cacheRegistry   = map[string]interface{ Stats() CacheStats }{}
+)
+
+func registerCache(c interface{ Stats() CacheStats }) {
+	cacheRegistryMu.Lock()
+	defer cacheRegistryMu.Unlock()
+	cacheRegistry[c.Stats().Name] = c
+}
+
+func getCacheStats() []CacheStats {
+	cacheRegistryMu.Lock()
+	defer cacheRegistryMu.Unlock()
+
+	stats := make([]CacheStats, 0, len(cacheRegistry))
+	for _, c := range cacheRegistry {
+		stats = append(stats, c.Stats())
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats
+}
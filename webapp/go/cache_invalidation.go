@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+)
+
+// 認証のキャッシュ(セッション・椅子のAPIキー)はインスタンスごとに持っているので、
+// ログアウトやAPIキーの失効、椅子の状態の変更で無効化するときは Redis の Pub/Sub で他のインスタンスにも伝える。
+// 伝わらなかった場合もキャッシュの TTL が過ぎれば反映される
+const cacheInvalidationChannel = "cache_invalidation"
+
+const (
+	cacheInvalidationSession     = "session"       // role のセッションで、key: トークンのハッシュ
+	cacheInvalidationChairAPIKey = "chair_api_key" // key: キーのハッシュ
+	cacheInvalidationSubject     = "subject"       // role と key(ID)の持ち主のセッションとAPIキー
+	cacheInvalidationAll         = "all"
+)
+
+type cacheInvalidation struct {
+	Kind string `json:"kind"`
+	Role string `json:"role,omitempty"`
+	Key  string `json:"key,omitempty"`
+}
+
+func applyCacheInvalidation(m cacheInvalidation) {
+	switch m.Kind {
+	case cacheInvalidationSession:
+		sessionCache.Del(sessionCacheKey(m.Role, m.Key))
+	case cacheInvalidationChairAPIKey:
+		chairAPIKeyCache.Del(m.Key)
+	case cacheInvalidationSubject:
+		sessionCache.DelFunc(func(_ string, c *cachedSession) bool {
+			return c.session.Role == m.Role && c.session.SubjectID == m.Key
+		})
+		if m.Role == sessionRoleChair {
+			chairAPIKeyCache.DelFunc(func(_ string, c *cachedChairAPIKey) bool {
+				return c.apiKey.ChairID == m.Key
+			})
+		}
+	case cacheInvalidationAll:
+		sessionCache.DelAll()
+		chairAPIKeyCache.DelAll()
+	default:
+		slog.Warn("unknown cache invalidation", slog.String("kind", m.Kind))
+	}
+}
+
+// 自分のキャッシュを無効化してから他のインスタンスに伝える。伝えられなくてもエラーにはしない
+func invalidateCache(ctx context.Context, m cacheInvalidation) {
+	applyCacheInvalidation(m)
+	payload, err := json.Marshal(m)
+	if err != nil {
+		slog.Error("failed to marshal cache invalidation", slog.Any("error", err))
+		return
+	}
+	if err := rdb.Publish(ctx, cacheInvalidationChannel, payload).Err(); err != nil {
+		slog.Error("failed to publish cache invalidation", slog.Any("error", err))
+	}
+}
+
+// 椅子の稼働状態などが変わったときに、変更をコミットした後で呼ぶ
+func invalidateSubjectCache(ctx context.Context, role, subjectID string) {
+	invalidateCache(ctx, cacheInvalidation{Kind: cacheInvalidationSubject, Role: role, Key: subjectID})
+}
+
+// go startCacheInvalidationSubscriber()
+func startCacheInvalidationSubscriber() {
+	pubsub := rdb.Subscribe(context.Background(), cacheInvalidationChannel)
+	defer pubsub.Close()
+
+	// 自分が送ったものも届くが、もう一度消すだけなので問題ない
+	for msg := range pubsub.Channel() {
+		m := cacheInvalidation{}
+		if err := json.Unmarshal([]byte(msg.Payload), &m); err != nil {
+			slog.Error("failed to unmarshal cache invalidation", slog.Any("error", err))
+			continue
+		}
+		applyCacheInvalidation(m)
+	}
+}
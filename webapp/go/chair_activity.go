@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 椅子の稼働状態(is_active)と vacant_chair は必ずここを通して一緒に更新する。
+// vacant_chair には稼働中かつ進行中のライドが無い椅子だけが入っている状態を保つ。
+// ライド中に停止しようとした場合は chair_pending_deactivations に記録しておき、ライドが完了した時点で停止する。
+// 稼働させた椅子はハートビートの監視を始める。
+// is_active を変えたら、呼び出し側でコミットした後に認証でキャッシュしている椅子を無効化する(invalidateSubjectCache)。
+// コミット前に無効化すると、その間に読まれたコミット前の椅子がまたキャッシュされてしまう
+
+// 停止がライド完了まで保留されたらtrueを返す。falseなら is_active を変えている
+func setChairActivity(ctx context.Context, tx *sqlx.Tx, chairID string, active bool) (bool, error) {
+	if _, err := tx.ExecContext(ctx, "SELECT id FROM isu1.chairs WHERE id = ? FOR UPDATE", chairID); err != nil {
+		return false, err
+	}
+
+	activeRideCount := 0
+	if err := tx.GetContext(ctx, &activeRideCount, `SELECT COUNT(*) FROM rides WHERE chair_id = ? AND status NOT IN ('COMPLETED', 'CANCELED')`, chairID); err != nil {
+		return false, err
+	}
+
+	if active {
+		if _, err := tx.ExecContext(ctx, "UPDATE isu1.chairs SET is_active = 1, updated_at = CURRENT_TIMESTAMP(6) WHERE id = ?", chairID); err != nil {
+			return false, err
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM chair_pending_deactivations WHERE chair_id = ?", chairID); err != nil {
+			return false, err
+		}
+		if activeRideCount == 0 {
+			if _, err := tx.ExecContext(ctx, "INSERT INTO vacant_chair (chair_id) VALUES (?) ON CONFLICT DO NOTHING", chairID); err != nil {
+				return false, err
+			}
+		}
+		if err := seedChairHeartbeat(ctx, chairID); err != nil {
+			return false, err
+		}
+		return false, nil
+	}
+
+	// 新しいライドを割り当てられないように、保留する場合でも先に vacant_chair からは外す
+	if _, err := tx.ExecContext(ctx, "DELETE FROM vacant_chair WHERE chair_id = ?", chairID); err != nil {
+		return false, err
+	}
+	if activeRideCount > 0 {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO chair_pending_deactivations (chair_id) VALUES (?) ON CONFLICT DO NOTHING", chairID); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE isu1.chairs SET is_active = 0, updated_at = CURRENT_TIMESTAMP(6) WHERE id = ?", chairID); err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+// 椅子の進行中のライドが全て完了したときに呼ぶ。停止が保留されていれば停止してtrueを返し、そうでなければ空き椅子に戻す
+func releaseChair(ctx context.Context, tx *sqlx.Tx, chairID string) (bool, error) {
+	result, err := tx.ExecContext(ctx, "DELETE FROM chair_pending_deactivations WHERE chair_id = ?", chairID)
+	if err != nil {
+		return false, err
+	}
+	deactivated, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if deactivated > 0 {
+		if _, err := tx.ExecContext(ctx, "UPDATE isu1.chairs SET is_active = 0, updated_at = CURRENT_TIMESTAMP(6) WHERE id = ?", chairID); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	if _, err := tx.ExecContext(ctx, "INSERT INTO vacant_chair (chair_id) SELECT id FROM isu1.chairs WHERE id = ? AND is_active = 1 ON CONFLICT DO NOTHING", chairID); err != nil {
+		return false, err
+	}
+	return false, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/samber/lo"
+)
+
+// 椅子はブラウザではないので、セッションのクッキーの代わりに Authorization: Bearer で認証することもできる。
+// Bearer にはセッションのトークンか、オーナーが椅子ごとに発行するAPIキーを送る。
+// APIキーはスコープで使えるAPIを絞れる。キーは発行時に一度だけ返し、DBにはハッシュだけを保存する
+const chairAPIKeyPrefix = "ck_"
+
+const (
+	chairScopeLocation = "location" // 位置情報の送信
+	chairScopeRides    = "rides"    // 通知の取得とライドの操作
+	chairScopeActivity = "activity" // 稼働状態と稼働時間帯の変更
+)
+
+func (k *ChairAPIKey) scopes() []string {
+	return strings.Split(k.Scopes, ",")
+}
+
+func (k *ChairAPIKey) hasScope(scope string) bool {
+	return lo.Contains(k.scopes(), scope)
+}
+
+// 新しいAPIキーを発行してキーを返す
+func createChairAPIKey(ctx context.Context, chairID, name string, scopes []string) (*ChairAPIKey, string, error) {
+	key := chairAPIKeyPrefix + secureRandomStr(32)
+	apiKey := &ChairAPIKey{
+		ID:        ulid.Make().String(),
+		ChairID:   chairID,
+		Name:      name,
+		KeyHash:   hashSessionToken(key),
+		KeyPrefix: key[:len(chairAPIKeyPrefix)+6],
+		Scopes:    strings.Join(lo.Uniq(scopes), ","),
+		CreatedAt: time.Now(),
+	}
+	if _, err := db.ExecContext(
+		ctx,
+		`INSERT INTO chair_api_keys (id, chair_id, name, key_hash, key_prefix, scopes, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		apiKey.ID, apiKey.ChairID, apiKey.Name, apiKey.KeyHash, apiKey.KeyPrefix, apiKey.Scopes, apiKey.CreatedAt,
+	); err != nil {
+		return nil, "", fmt.Errorf("failed to insert chair api key: %w", err)
+	}
+	return apiKey, key, nil
+}
+
+func selectChairAPIKeys(ctx context.Context, chairID string) ([]ChairAPIKey, error) {
+	apiKeys := []ChairAPIKey{}
+	if err := db.SelectContext(ctx, &apiKeys, `SELECT * FROM chair_api_keys WHERE chair_id = ? ORDER BY created_at DESC`, chairID); err != nil {
+		return nil, fmt.Errorf("failed to select chair api keys: %w", err)
+	}
+	return apiKeys, nil
+}
+
+// 有効なキーが無ければ sql.ErrNoRows
+func revokeChairAPIKey(ctx context.Context, chairID, keyID string) error {
+	apiKey := &ChairAPIKey{}
+	if err := db.GetContext(
+		ctx,
+		apiKey,
+		`UPDATE chair_api_keys SET revoked_at = CURRENT_TIMESTAMP(6) WHERE id = ? AND chair_id = ? AND revoked_at IS NULL RETURNING *`,
+		keyID, chairID,
+	); err != nil {
+		return err
+	}
+	invalidateCache(ctx, cacheInvalidation{Kind: cacheInvalidationChairAPIKey, Key: apiKey.KeyHash})
+	return nil
+}
+
+type cachedChairAPIKey struct {
+	apiKey *ChairAPIKey
+	chair  *Chair
+}
+
+var chairAPIKeyCache = NewCache[string, *cachedChairAPIKey](
+	WithCacheName("chair_api_keys"),
+	WithCacheCapacity(sessionCacheSize),
+	WithCacheTTL(sessionCacheTTL),
+	WithCacheNegative(sessionNegativeCacheTTL, isNotFound),
+)
+
+// 有効なAPIキーとその椅子を返す。キーが無い・失効していれば sql.ErrNoRows
+func getChairByAPIKey(ctx context.Context, key string) (*Chair, *ChairAPIKey, error) {
+	ctx, span := tracer.Start(ctx, "getChairByAPIKey")
+	defer span.End()
+
+	keyHash := hashSessionToken(key)
+	c, err := chairAPIKeyCache.GetOrLoad(keyHash, func() (*cachedChairAPIKey, error) {
+		return loadChairAPIKey(context.WithoutCancel(ctx), keyHash)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.chair, c.apiKey, nil
+}
+
+// キャッシュから外れたときだけ最終利用日時を更新する
+func loadChairAPIKey(ctx context.Context, keyHash string) (*cachedChairAPIKey, error) {
+	apiKey := &ChairAPIKey{}
+	if err := db.GetContext(
+		ctx,
+		apiKey,
+		`UPDATE chair_api_keys SET last_used_at = CURRENT_TIMESTAMP(6) WHERE key_hash = ? AND revoked_at IS NULL RETURNING *`,
+		keyHash,
+	); err != nil {
+		return nil, err
+	}
+	chair := &Chair{}
+	if err := db.GetContext(ctx, chair, chairSubjectQuery, apiKey.ChairID); err != nil {
+		return nil, err
+	}
+	return &cachedChairAPIKey{apiKey: apiKey, chair: chair}, nil
+}
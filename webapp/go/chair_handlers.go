@@ -1,19 +1,22 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
 
+	"github.com/isucon/isucon14/webapp/go/auth"
+	"github.com/jmoiron/sqlx"
 	"github.com/oklog/ulid/v2"
 )
 
 type chairPostChairsRequest struct {
-	Name               string `json:"name"`
-	Model              string `json:"model"`
-	ChairRegisterToken string `json:"chair_register_token"`
+	Name               string `json:"name" validate:"required,max=30"`
+	Model              string `json:"model" validate:"required,max=50"`
+	ChairRegisterToken string `json:"chair_register_token" validate:"required,max=255"`
 }
 
 type chairPostChairsResponse struct {
@@ -28,11 +31,7 @@ func chairPostChairs(w http.ResponseWriter, r *http.Request) {
 
 	req := &chairPostChairsRequest{}
 	if err := bindJSON(r, req); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-	if req.Name == "" || req.Model == "" || req.ChairRegisterToken == "" {
-		writeError(w, http.StatusBadRequest, errors.New("some of required fields(name, model, chair_register_token) are empty"))
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
 
@@ -47,23 +46,36 @@ func chairPostChairs(w http.ResponseWriter, r *http.Request) {
 	}
 
 	chairID := ulid.Make().String()
-	accessToken := secureRandomStr(32)
 
-	_, err := db.ExecContext(
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	token, err := createSession(ctx, tx, sessionRoleChair, chairID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	_, err = tx.ExecContext(
 		ctx,
-		"INSERT INTO isu1.chairs (id, owner_id, name, model, is_active, access_token,created_at,updated_at) VALUES (?, ?, ?, ?, ?, ?,now(),now())",
-		chairID, owner.ID, req.Name, req.Model, 0, accessToken,
+		"INSERT INTO isu1.chairs (id, owner_id, name, model, is_active,created_at,updated_at) VALUES (?, ?, ?, ?, ?,now(),now())",
+		chairID, owner.ID, req.Name, req.Model, 0,
 	)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Path:  "/",
-		Name:  "chair_session",
-		Value: accessToken,
-	})
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	setSessionCookie(w, sessionRoleChair, token)
 
 	writeJSON(w, http.StatusCreated, &chairPostChairsResponse{
 		ID:      chairID,
@@ -71,8 +83,21 @@ func chairPostChairs(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+func chairPostLogout(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	_, span := tracer.Start(ctx, "chairPostLogout")
+	defer span.End()
+
+	// APIキーにはセッションが無いのでログアウトしても失効しない。204 を返すと失効したと誤解されるので断る
+	if _, err := auth.From[ChairAPIKey](ctx); err == nil {
+		writeError(w, http.StatusBadRequest, errors.New("api key cannot log out; revoke it with DELETE /api/owner/chairs/{chair_id}/api-keys/{key_id}"))
+		return
+	}
+	logout(w, r, sessionRoleChair)
+}
+
 type postChairActivityRequest struct {
-	IsActive bool `json:"is_active"`
+	IsActive *bool `json:"is_active" validate:"required"`
 }
 
 func chairPostActivity(w http.ResponseWriter, r *http.Request) {
@@ -80,48 +105,130 @@ func chairPostActivity(w http.ResponseWriter, r *http.Request) {
 	_, span := tracer.Start(ctx, "chairPostActivity")
 	defer span.End()
 
-	chair := ctx.Value("chair").(*Chair)
+	chair, err := ChairFrom(ctx)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
 
 	req := &postChairActivityRequest{}
 	if err := bindJSON(r, req); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
 
-	isActive := 0
-	if req.IsActive {
-		isActive = 1
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
 	}
+	defer tx.Rollback()
 
-	_, err := db.ExecContext(ctx, "UPDATE isu1.chairs SET is_active = ?, updated_at = CURRENT_TIMESTAMP(6) WHERE id = ?", isActive, chair.ID)
+	// ライド中の停止はライドが完了するまで保留される
+	deferred, err := setChairActivity(ctx, tx, chair.ID, *req.IsActive)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-	if _, err := db.ExecContext(ctx, "INSERT INTO vacant_chair (chair_id) VALUES (?) ON CONFLICT DO NOTHING", chair.ID); err != nil {
+
+	if err := tx.Commit(); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	if !deferred {
+		invalidateSubjectCache(ctx, sessionRoleChair, chair.ID)
+	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
-type chairPostCoordinateResponse struct {
-	RecordedAt int64 `json:"recorded_at"`
+type chairSchedule struct {
+	Weekday int    `json:"weekday" validate:"min=0,max=6"`
+	Start   string `json:"start" validate:"required"`
+	End     string `json:"end" validate:"required"`
 }
 
-func chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
+type chairSchedulesRequestResponse struct {
+	Schedules []chairSchedule `json:"schedules"`
+}
+
+func chairGetSchedules(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	_, span := tracer.Start(ctx, "chairPostCoordinate")
+	_, span := tracer.Start(ctx, "chairGetSchedules")
 	defer span.End()
 
-	req := &Coordinate{}
+	chair, err := ChairFrom(ctx)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	schedules, err := getChairSchedules(ctx, db, chair.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	items := make([]chairSchedule, 0, len(schedules))
+	for _, s := range schedules {
+		items = append(items, chairSchedule{
+			Weekday: s.Weekday,
+			Start:   formatScheduleMinute(s.StartMinute),
+			End:     formatScheduleMinute(s.EndMinute),
+		})
+	}
+	writeJSON(w, http.StatusOK, &chairSchedulesRequestResponse{Schedules: items})
+}
+
+// 稼働時間帯を丸ごと置き換える。空配列なら時間帯による自動切り替えをやめる
+func chairPutSchedules(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	_, span := tracer.Start(ctx, "chairPutSchedules")
+	defer span.End()
+
+	chair, err := ChairFrom(ctx)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	req := &chairSchedulesRequestResponse{}
 	if err := bindJSON(r, req); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
 
-	chair := ctx.Value("chair").(*Chair)
+	type scheduleKey struct {
+		weekday int
+		start   int
+	}
+	seen := map[scheduleKey]struct{}{}
+	schedules := make([]ChairSchedule, 0, len(req.Schedules))
+	for _, item := range req.Schedules {
+		start, err := parseScheduleMinute(item.Start)
+		if err != nil || start == 24*60 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("start is invalid: %s", item.Start))
+			return
+		}
+		end, err := parseScheduleMinute(item.End)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("end is invalid: %s", item.End))
+			return
+		}
+		// 同じ曜日・開始時刻の枠は1つしか登録できない
+		key := scheduleKey{weekday: item.Weekday, start: start}
+		if _, ok := seen[key]; ok {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("duplicate schedule: weekday %d, start %s", item.Weekday, item.Start))
+			return
+		}
+		seen[key] = struct{}{}
+		schedules = append(schedules, ChairSchedule{
+			ChairID:     chair.ID,
+			Weekday:     item.Weekday,
+			StartMinute: start,
+			EndMinute:   end,
+		})
+	}
 
 	tx, err := db.Beginx()
 	if err != nil {
@@ -130,21 +237,54 @@ func chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
-	if _, err := tx.ExecContext(ctx, "SELECT id FROM isu1.chairs WHERE id = ? FOR UPDATE", chair.ID); err != nil {
+	if err := replaceChairSchedules(ctx, tx, chair.ID, schedules); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-	before := &ChairLocation{}
 
-	if err := tx.GetContext(ctx, before, "SELECT * FROM isu1.chair_locations WHERE chair_id = ? ORDER BY id DESC LIMIT 1", chair.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+	if err := tx.Commit(); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-	var distance int
-	if before.ID != "" {
-		distance = calculateDistance(before.Latitude, before.Longitude, req.Latitude, req.Longitude)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type chairPostCoordinateResponse struct {
+	RecordedAt int64 `json:"recorded_at"`
+}
+
+func chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	_, span := tracer.Start(ctx, "chairPostCoordinate")
+	defer span.End()
+
+	req := &Coordinate{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	chair, err := ChairFrom(ctx)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+	if err := touchChairHeartbeat(ctx, chair.ID); err != nil {
+		slog.ErrorContext(ctx, "chairPostCoordinate: failed to touch heartbeat", slog.Any("error", err), slog.String("chair_id", chair.ID))
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
 	}
+	defer tx.Rollback()
 
+	if _, err := tx.ExecContext(ctx, "SELECT id FROM isu1.chairs WHERE id = ? FOR UPDATE", chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
 	chairLocationID := ulid.Make().String()
 	if _, err := tx.ExecContext(
 		ctx,
@@ -161,28 +301,37 @@ func chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ride := &Ride{}
-	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE chair_id = ? ORDER BY updated_at DESC LIMIT 1`, chair.ID); err != nil {
-		if !errors.Is(err, sql.ErrNoRows) {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-	} else {
-		status, err := getLatestRideStatus(ctx, tx, ride.ID)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-		if status != "COMPLETED" && status != "CANCELED" {
-			if req.Latitude == ride.PickupLatitude && req.Longitude == ride.PickupLongitude && status == "ENROUTE" {
-				if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "PICKUP"); err != nil {
-					writeError(w, http.StatusInternalServerError, err)
-					return
-				}
+	// 相乗りの場合は進行中のライドが複数あるので、それぞれの状態を進める
+	rides := []Ride{}
+	if err := tx.SelectContext(ctx, &rides, `SELECT * FROM rides WHERE chair_id = ? AND status NOT IN ('COMPLETED', 'CANCELED') ORDER BY updated_at`, chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	for _, ride := range rides {
+		status := ride.Status
+		if req.Latitude == ride.PickupLatitude && req.Longitude == ride.PickupLongitude && status == "ENROUTE" {
+			if err := insertRideStatus(ctx, tx, ride.ID, "PICKUP"); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
 			}
+		}
 
-			if req.Latitude == ride.DestinationLatitude && req.Longitude == ride.DestinationLongitude && status == "CARRYING" {
-				if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "ARRIVED"); err != nil {
+		if status == "CARRYING" {
+			// 経由地は順番に回る。全て回り終えるまでは目的地に着いても ARRIVED にしない
+			nextWaypoint, err := getNextRideWaypoint(ctx, tx, ride.ID)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if nextWaypoint != nil {
+				if req.Latitude == nextWaypoint.Latitude && req.Longitude == nextWaypoint.Longitude {
+					if _, err := tx.ExecContext(ctx, `UPDATE ride_waypoints SET status = 'REACHED', reached_at = CURRENT_TIMESTAMP(6) WHERE ride_id = ? AND position = ?`, ride.ID, nextWaypoint.Position); err != nil {
+						writeError(w, http.StatusInternalServerError, err)
+						return
+					}
+				}
+			} else if req.Latitude == ride.DestinationLatitude && req.Longitude == ride.DestinationLongitude {
+				if err := insertRideStatus(ctx, tx, ride.ID, "ARRIVED"); err != nil {
 					writeError(w, http.StatusInternalServerError, err)
 					return
 				}
@@ -194,9 +343,10 @@ func chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-	if err := addChairTotalDistance(ctx, chair.ID, int(distance), location.CreatedAt.UnixMilli()); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
+	// 位置情報はコミット済みなので、ここで失敗しても500は返さない。
+	// 反映し損ねた点の分は総距離が短くなるので verify-total-distance -repair で直す
+	if err := applyChairLocationToTotalDistance(ctx, location); err != nil {
+		slog.ErrorContext(ctx, "chairPostCoordinate: failed to apply total distance", slog.Any("error", err), slog.String("chair_location_id", location.ID))
 	}
 
 	writeJSON(w, http.StatusOK, &chairPostCoordinateResponse{
@@ -205,8 +355,9 @@ func chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
 }
 
 type simpleUser struct {
-	ID   string `json:"id"`
-	Name string `json:"name"`
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Reputation userStats `json:"reputation"`
 }
 
 type chairGetNotificationResponse struct {
@@ -215,11 +366,14 @@ type chairGetNotificationResponse struct {
 }
 
 type chairGetNotificationResponseData struct {
-	RideID                string     `json:"ride_id"`
-	User                  simpleUser `json:"user"`
-	PickupCoordinate      Coordinate `json:"pickup_coordinate"`
-	DestinationCoordinate Coordinate `json:"destination_coordinate"`
-	Status                string     `json:"status"`
+	RideID                string      `json:"ride_id"`
+	User                  simpleUser  `json:"user"`
+	PickupCoordinate      Coordinate  `json:"pickup_coordinate"`
+	DestinationCoordinate Coordinate  `json:"destination_coordinate"`
+	NextWaypoint          *Coordinate `json:"next_waypoint,omitempty"`
+	Status                string      `json:"status"`
+	// 相乗りで同じ椅子に割り当てられている他のライド
+	PooledRides []chairGetNotificationResponseData `json:"pooled_rides,omitempty"`
 }
 
 func chairGetNotification(w http.ResponseWriter, r *http.Request) {
@@ -227,7 +381,14 @@ func chairGetNotification(w http.ResponseWriter, r *http.Request) {
 	_, span := tracer.Start(ctx, "chairGetNotification")
 	defer span.End()
 
-	chair := ctx.Value("chair").(*Chair)
+	chair, err := ChairFrom(ctx)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+	if err := touchChairHeartbeat(ctx, chair.ID); err != nil {
+		slog.ErrorContext(ctx, "chairGetNotification: failed to touch heartbeat", slog.Any("error", err), slog.String("chair_id", chair.ID))
+	}
 
 	tx, err := db.Beginx()
 	if err != nil {
@@ -236,10 +397,12 @@ func chairGetNotification(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 	ride := &Ride{}
-	yetSentRideStatus := RideStatus{}
-	status := ""
 
-	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE chair_id = ? ORDER BY updated_at DESC LIMIT 1`, chair.ID); err != nil {
+	// 管理者が取り消したライドは、取り消しを通知した後は今のライドとして扱わない
+	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides
+WHERE chair_id = ?
+  AND (status <> 'CANCELED' OR EXISTS (SELECT 1 FROM ride_statuses WHERE ride_id = rides.id AND chair_sent_at IS NULL))
+ORDER BY updated_at DESC LIMIT 1`, chair.ID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			writeJSON(w, http.StatusOK, &chairGetNotificationResponse{
 				RetryAfterMs: 30,
@@ -250,70 +413,128 @@ func chairGetNotification(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := tx.GetContext(ctx, &yetSentRideStatus, `SELECT * FROM ride_statuses WHERE ride_id = ? AND chair_sent_at IS NULL ORDER BY created_at ASC LIMIT 1`, ride.ID); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			status, err = getLatestRideStatus(ctx, tx, ride.ID)
-			if err != nil {
-				writeError(w, http.StatusInternalServerError, err)
-				return
-			}
-		} else {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-	} else {
-		status = yetSentRideStatus.Status
-	}
-
-	user := &User{}
-	err = tx.GetContext(ctx, user, "SELECT * FROM users WHERE id = ? FOR SHARE", ride.UserID)
+	data, sentStatus, err := chairNotificationDataForRide(ctx, tx, ride)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	completed := sentStatus == "COMPLETED"
 
-	if yetSentRideStatus.ID != "" {
-		_, err := tx.ExecContext(ctx, `UPDATE ride_statuses SET chair_sent_at = CURRENT_TIMESTAMP(6) WHERE id = ?`, yetSentRideStatus.ID)
+	// 相乗り中は同じ椅子に割り当てられた他の進行中のライドもそれぞれ状態を通知する
+	pooledRides := []Ride{}
+	if err := tx.SelectContext(
+		ctx,
+		&pooledRides,
+		`SELECT * FROM rides
+WHERE chair_id = ? AND id <> ?
+  AND (status NOT IN ('COMPLETED', 'CANCELED') OR EXISTS (SELECT 1 FROM ride_statuses WHERE ride_id = rides.id AND chair_sent_at IS NULL))
+ORDER BY updated_at`,
+		chair.ID, ride.ID,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	for _, pooledRide := range pooledRides {
+		pooledData, pooledSentStatus, err := chairNotificationDataForRide(ctx, tx, &pooledRide)
 		if err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
+		data.PooledRides = append(data.PooledRides, *pooledData)
+		completed = completed || pooledSentStatus == "COMPLETED"
 	}
-	if yetSentRideStatus.Status == "COMPLETED" {
-		if _, err := tx.ExecContext(ctx, "INSERT INTO vacant_chair (chair_id) VALUES (?) ON CONFLICT DO NOTHING", chair.ID); err != nil {
+
+	deactivated := false
+	if completed {
+		activeRideCount := 0
+		if err := tx.GetContext(ctx, &activeRideCount, `SELECT COUNT(*) FROM rides WHERE chair_id = ? AND status NOT IN ('COMPLETED', 'CANCELED')`, chair.ID); err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
+		if activeRideCount == 0 {
+			deactivated, err = releaseChair(ctx, tx, chair.ID)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+		}
 	}
 
 	if err := tx.Commit(); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	if deactivated {
+		invalidateSubjectCache(ctx, sessionRoleChair, chair.ID)
+	}
 
 	writeJSON(w, http.StatusOK, &chairGetNotificationResponse{
-		Data: &chairGetNotificationResponseData{
-			RideID: ride.ID,
-			User: simpleUser{
-				ID:   user.ID,
-				Name: fmt.Sprintf("%s %s", user.Firstname, user.Lastname),
-			},
-			PickupCoordinate: Coordinate{
-				Latitude:  ride.PickupLatitude,
-				Longitude: ride.PickupLongitude,
-			},
-			DestinationCoordinate: Coordinate{
-				Latitude:  ride.DestinationLatitude,
-				Longitude: ride.DestinationLongitude,
-			},
-			Status: status,
-		},
+		Data:         data,
 		RetryAfterMs: 30,
 	})
 }
 
+// まだ椅子に通知していない状態があれば古い順に1つ通知済みにして返す。無ければ現在の状態を返す。
+// 2つ目の戻り値は今回通知済みにした状態(無ければ空文字)
+func chairNotificationDataForRide(ctx context.Context, tx *sqlx.Tx, ride *Ride) (*chairGetNotificationResponseData, string, error) {
+	yetSentRideStatus := RideStatus{}
+	status := ""
+	if err := tx.GetContext(ctx, &yetSentRideStatus, `SELECT * FROM ride_statuses WHERE ride_id = ? AND chair_sent_at IS NULL ORDER BY created_at ASC LIMIT 1`, ride.ID); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, "", err
+		}
+		status = ride.Status
+	} else {
+		status = yetSentRideStatus.Status
+	}
+	// 椅子から見るとマッチング中のライドは自分へのオファー
+	if status == "MATCHING" {
+		status = "OFFERED"
+	}
+
+	user := &User{}
+	if err := tx.GetContext(ctx, user, "SELECT * FROM users WHERE id = ? FOR SHARE", ride.UserID); err != nil {
+		return nil, "", err
+	}
+
+	reputation, err := getUserStats(ctx, tx, user.ID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	nextWaypoint, err := getNextRideWaypoint(ctx, tx, ride.ID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if yetSentRideStatus.ID != "" {
+		if _, err := tx.ExecContext(ctx, `UPDATE ride_statuses SET chair_sent_at = CURRENT_TIMESTAMP(6) WHERE id = ?`, yetSentRideStatus.ID); err != nil {
+			return nil, "", err
+		}
+	}
+
+	return &chairGetNotificationResponseData{
+		RideID: ride.ID,
+		User: simpleUser{
+			ID:         user.ID,
+			Name:       fmt.Sprintf("%s %s", user.Firstname, user.Lastname),
+			Reputation: reputation,
+		},
+		PickupCoordinate: Coordinate{
+			Latitude:  ride.PickupLatitude,
+			Longitude: ride.PickupLongitude,
+		},
+		DestinationCoordinate: Coordinate{
+			Latitude:  ride.DestinationLatitude,
+			Longitude: ride.DestinationLongitude,
+		},
+		NextWaypoint: nextWaypoint.coordinate(),
+		Status:       status,
+	}, yetSentRideStatus.Status, nil
+}
+
 type postChairRidesRideIDStatusRequest struct {
-	Status string `json:"status"`
+	Status string `json:"status" validate:"required,oneof=ENROUTE REJECTED CARRYING"`
 }
 
 func chairPostRideStatus(w http.ResponseWriter, r *http.Request) {
@@ -323,7 +544,11 @@ func chairPostRideStatus(w http.ResponseWriter, r *http.Request) {
 
 	rideID := r.PathValue("ride_id")
 
-	chair := ctx.Value("chair").(*Chair)
+	chair, err := ChairFrom(ctx)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
 
 	req := &postChairRidesRideIDStatusRequest{}
 	if err := bindJSON(r, req); err != nil {
@@ -354,30 +579,134 @@ func chairPostRideStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	accepted := false
+	deactivated := false
 	switch req.Status {
 	// Acknowledge the ride
 	case "ENROUTE":
-		if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "ENROUTE"); err != nil {
+		if ride.Status != "MATCHING" {
+			writeError(w, http.StatusBadRequest, errors.New("offer has already been accepted"))
+			return
+		}
+		// 期限切れや取り消し済みのオファーは受けられない
+		accepted, err = resolveRideAssignment(ctx, tx, ride.ID, "ACKNOWLEDGED")
+		if err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
-	// After Picking up user
-	case "CARRYING":
-		status, err := getLatestRideStatus(ctx, tx, ride.ID)
+		if !accepted {
+			writeError(w, http.StatusConflict, errors.New("offer is no longer valid"))
+			return
+		}
+		if err := insertRideStatus(ctx, tx, ride.ID, "ENROUTE"); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	// Reject the offer
+	case "REJECTED":
+		if ride.Status != "MATCHING" {
+			writeError(w, http.StatusBadRequest, errors.New("offer has already been accepted"))
+			return
+		}
+		deactivated, err = rejectRideOffer(ctx, tx, ride, chair.ID)
 		if err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
-		if status != "PICKUP" {
+	// After Picking up user
+	case "CARRYING":
+		if ride.Status != "PICKUP" {
 			writeError(w, http.StatusBadRequest, errors.New("chair has not arrived yet"))
 			return
 		}
-		if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "CARRYING"); err != nil {
+		if err := insertRideStatus(ctx, tx, ride.ID, "CARRYING"); err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
 	default:
 		writeError(w, http.StatusBadRequest, errors.New("invalid status"))
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if deactivated {
+		invalidateSubjectCache(ctx, sessionRoleChair, chair.ID)
+	}
+
+	offerResult := ""
+	if accepted {
+		offerResult = "accepted"
+	} else if req.Status == "REJECTED" {
+		offerResult = "rejected"
+	}
+	if offerResult != "" {
+		if err := addChairOfferCount(ctx, chair.ID, offerResult); err != nil {
+			slog.ErrorContext(ctx, "chairPostRideStatus: failed to add offer count", slog.Any("error", err), slog.String("chair_id", chair.ID))
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type chairPostRideEvaluationRequest struct {
+	Evaluation int `json:"evaluation" validate:"min=1,max=5"`
+}
+
+// 椅子が乗客を評価する。到着(ARRIVED)以降に1回だけ評価できる
+func chairPostRideEvaluation(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	_, span := tracer.Start(ctx, "chairPostRideEvaluation")
+	defer span.End()
+
+	rideID := r.PathValue("ride_id")
+
+	chair, err := ChairFrom(ctx)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	req := &chairPostRideEvaluationRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	ride := &Ride{}
+	if err := tx.GetContext(ctx, ride, "SELECT * FROM rides WHERE id = ? FOR UPDATE", rideID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("ride not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if ride.ChairID.String != chair.ID {
+		writeError(w, http.StatusNotFound, errors.New("ride not found"))
+		return
+	}
+	if ride.Status != "ARRIVED" && ride.Status != "COMPLETED" {
+		writeError(w, http.StatusBadRequest, errors.New("not arrived yet"))
+		return
+	}
+	if ride.UserEvaluation != nil {
+		writeError(w, http.StatusConflict, errors.New("already evaluated"))
+		return
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE rides SET user_evaluation = ? WHERE id = ?`, req.Evaluation, ride.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/redis/go-redis/v9"
+)
+
+// 椅子からのリクエスト(位置情報の送信・通知のポーリング)をハートビートとして Redis に記録する。
+// CHAIR_HEARTBEAT_TIMEOUT の間ハートビートが無い椅子は停止中とみなしてマッチング対象から外し、
+// 割り当て済みでまだ乗せていないライドはマッチング待ちに戻す。
+// 停止中とみなした椅子は chair_stale に最後のハートビート時刻を残しておき、ハートビートが再開したら空き椅子に戻す
+var (
+	chairHeartbeatTimeout       = GetEnvDuration("CHAIR_HEARTBEAT_TIMEOUT", "1m")
+	chairHeartbeatCheckInterval = GetEnvDuration("CHAIR_HEARTBEAT_CHECK_INTERVAL", "10s")
+)
+
+const (
+	chairHeartbeatsKey = "chair_heartbeats"
+	chairStaleKey      = "chair_stale"
+)
+
+// KEYS: chair_heartbeats, chair_stale
+// ARGV: chair_id, threshold
+// ハートビートが threshold 以前のままなら停止中に移して1を返す。他のインスタンスが先に移していたら0
+var markChairStaleScript = redis.NewScript(`
+local score = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if not score or tonumber(score) > tonumber(ARGV[2]) then
+  return 0
+end
+redis.call('ZREM', KEYS[1], ARGV[1])
+redis.call('HSET', KEYS[2], ARGV[1], score)
+return 1
+`)
+
+// 停止中とみなしていた椅子からのハートビートなら空き椅子に戻す
+func touchChairHeartbeat(ctx context.Context, chairID string) error {
+	var recovered *redis.IntCmd
+	if _, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, chairHeartbeatsKey, redis.Z{Score: float64(time.Now().UnixMilli()), Member: chairID})
+		recovered = pipe.HDel(ctx, chairStaleKey, chairID)
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to touch chair heartbeat: %w", err)
+	}
+	if recovered.Val() == 0 {
+		return nil
+	}
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	activeRideCount := 0
+	if err := tx.GetContext(ctx, &activeRideCount, `SELECT COUNT(*) FROM rides WHERE chair_id = ? AND status NOT IN ('COMPLETED', 'CANCELED')`, chairID); err != nil {
+		return err
+	}
+	deactivated := false
+	if activeRideCount == 0 {
+		deactivated, err = releaseChair(ctx, tx, chairID)
+		if err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if deactivated {
+		invalidateSubjectCache(ctx, sessionRoleChair, chairID)
+	}
+	return nil
+}
+
+// 稼働を始めた椅子は、まだリクエストを送っていなくてもハートビートの監視対象にする。
+// 停止中とみなしていた椅子でも、稼働させたときに空き椅子に戻しているので印を消す
+func seedChairHeartbeat(ctx context.Context, chairID string) error {
+	if _, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, chairHeartbeatsKey, redis.Z{Score: float64(time.Now().UnixMilli()), Member: chairID})
+		pipe.HDel(ctx, chairStaleKey, chairID)
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to seed chair heartbeat: %w", err)
+	}
+	return nil
+}
+
+// 初期化直後にまだリクエストを送っていない椅子がすぐ停止扱いにならないよう、稼働中の椅子のハートビートを今にしておく
+func initializeChairHeartbeats(ctx context.Context) error {
+	chairIDs := []string{}
+	if err := db.SelectContext(ctx, &chairIDs, `SELECT id FROM isu1.chairs WHERE is_active = 1`); err != nil {
+		return fmt.Errorf("failed to select active chairs: %w", err)
+	}
+	if len(chairIDs) == 0 {
+		return nil
+	}
+	now := float64(time.Now().UnixMilli())
+	members := make([]redis.Z, 0, len(chairIDs))
+	for _, id := range chairIDs {
+		members = append(members, redis.Z{Score: now, Member: id})
+	}
+	if err := rdb.ZAdd(ctx, chairHeartbeatsKey, members...).Err(); err != nil {
+		return fmt.Errorf("failed to initialize chair heartbeats: %w", err)
+	}
+	return nil
+}
+
+// go startChairHeartbeatCheck()
+func startChairHeartbeatCheck() {
+	if chairHeartbeatCheckInterval <= 0 || chairHeartbeatTimeout <= 0 {
+		slog.Info("chair heartbeat check is disabled")
+		return
+	}
+	t := NewTicker(int(chairHeartbeatCheckInterval.Milliseconds()), func() {
+		if err := evictStaleChairs(context.Background(), time.Now().Add(-chairHeartbeatTimeout)); err != nil {
+			slog.Error("failed to evict stale chairs", slog.Any("error", err))
+		}
+	})
+	t.Start()
+}
+
+func evictStaleChairs(ctx context.Context, threshold time.Time) error {
+	ctx, span := tracer.Start(ctx, "evictStaleChairs")
+	defer span.End()
+
+	chairIDs, err := rdb.ZRangeByScore(ctx, chairHeartbeatsKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(threshold.UnixMilli(), 10),
+	}).Result()
+	if err != nil {
+		return fmt.Errorf("failed to select stale chairs: %w", err)
+	}
+
+	for _, chairID := range chairIDs {
+		marked, err := markChairStaleScript.Run(ctx, rdb, []string{chairHeartbeatsKey, chairStaleKey}, chairID, threshold.UnixMilli()).Int()
+		if err != nil {
+			return fmt.Errorf("failed to mark chair %s stale: %w", chairID, err)
+		}
+		if marked == 0 {
+			continue
+		}
+		if err := evictStaleChair(ctx, chairID); err != nil {
+			return fmt.Errorf("failed to evict stale chair %s: %w", chairID, err)
+		}
+		slog.Info("evicted stale chair", slog.String("chair_id", chairID))
+	}
+	return nil
+}
+
+func evictStaleChair(ctx context.Context, chairID string) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM vacant_chair WHERE chair_id = ?", chairID); err != nil {
+		return err
+	}
+
+	// まだ乗客を乗せていないライドは割り当てを外してマッチング待ちに戻す
+	rides := []Ride{}
+	if err := tx.SelectContext(ctx, &rides, `SELECT * FROM rides WHERE chair_id = ? AND status IN ('MATCHING', 'ENROUTE') FOR UPDATE`, chairID); err != nil {
+		return err
+	}
+	for _, ride := range rides {
+		if err := requeueRide(ctx, tx, &ride); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ライドから椅子の割り当てを外してマッチング待ちに戻す。
+// まだ乗せていないので相乗りは成立しておらず、相手のライドの割引も取り消す
+func requeueRide(ctx context.Context, tx *sqlx.Tx, ride *Ride) error {
+	if _, err := resolveRideAssignment(ctx, tx, ride.ID, "REVOKED"); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE rides SET chair_id = NULL, pooled_with = NULL, pool_discount = 0, updated_at = CURRENT_TIMESTAMP(6) WHERE id = ?`, ride.ID); err != nil {
+		return err
+	}
+	if ride.PooledWith.Valid {
+		if _, err := tx.ExecContext(ctx, `UPDATE rides SET pooled_with = NULL, pool_discount = 0 WHERE id = ?`, ride.PooledWith.String); err != nil {
+			return err
+		}
+	}
+	if ride.Status != "MATCHING" {
+		if err := insertRideStatus(ctx, tx, ride.ID, "MATCHING"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isChairStale(ctx context.Context, chairID string) (bool, error) {
+	stale, err := rdb.HExists(ctx, chairStaleKey, chairID).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to check stale chair: %w", err)
+	}
+	return stale, nil
+}
+
+type staleChair struct {
+	ChairID    string
+	LastSeenAt int64
+}
+
+// 停止中とみなしている椅子を返す
+func getStaleChairs(ctx context.Context, chairIDs []string) ([]staleChair, error) {
+	if len(chairIDs) == 0 {
+		return []staleChair{}, nil
+	}
+	vals, err := rdb.HMGet(ctx, chairStaleKey, chairIDs...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stale chairs: %w", err)
+	}
+	stales := []staleChair{}
+	for i, v := range vals {
+		if v == nil {
+			continue
+		}
+		lastSeenAt, err := strconv.ParseFloat(v.(string), 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse last seen at: %w", err)
+		}
+		stales = append(stales, staleChair{ChairID: chairIDs[i], LastSeenAt: int64(lastSeenAt)})
+	}
+	return stales, nil
+}
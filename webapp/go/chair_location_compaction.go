@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// chair_locations は追記されるだけで肥大化し続けるので、定期的に古い位置情報を間引く。
+// 保持期間(CHAIR_LOCATION_RETENTION)内の点はそのまま残し、それより古い点は
+// CHAIR_LOCATION_DOWNSAMPLE_INTERVAL ごとに1点だけ残す。ライドの配車位置・目的地と一致する点は境界として必ず残す。
+// 間引く前に椅子ごとの移動距離を chair_distance_checkpoints に畳み込んでおき、
+// 総移動距離はチェックポイント + それ以降の点から再計算できるようにする。
+var (
+	chairLocationCompactionInterval = GetEnvDuration("CHAIR_LOCATION_COMPACTION_INTERVAL", "1m")
+	chairLocationRetention          = GetEnvDuration("CHAIR_LOCATION_RETENTION", "24h")
+	chairLocationDownsampleInterval = GetEnvDuration("CHAIR_LOCATION_DOWNSAMPLE_INTERVAL", "1m")
+)
+
+type ChairDistanceCheckpoint struct {
+	ChairID        string         `db:"chair_id"`
+	TotalDistance  int            `db:"total_distance"`
+	LastLocationID sql.NullString `db:"last_location_id"`
+	LastLatitude   sql.NullInt64  `db:"last_latitude"`
+	LastLongitude  sql.NullInt64  `db:"last_longitude"`
+	CheckpointAt   sql.NullTime   `db:"checkpoint_at"`
+}
+
+// go startChairLocationCompaction()
+func startChairLocationCompaction() {
+	if chairLocationCompactionInterval <= 0 {
+		slog.Info("chair location compaction is disabled")
+		return
+	}
+	t := NewTicker(int(chairLocationCompactionInterval.Milliseconds()), func() {
+		if err := compactChairLocations(context.Background(), time.Now().Add(-chairLocationRetention)); err != nil {
+			slog.Error("failed to compact chair locations", slog.Any("error", err))
+		}
+	})
+	t.Start()
+}
+
+func compactChairLocations(ctx context.Context, cutoff time.Time) error {
+	ctx, span := tracer.Start(ctx, "compactChairLocations")
+	defer span.End()
+
+	chairIDs := []string{}
+	if err := db.SelectContext(ctx, &chairIDs, `
+SELECT DISTINCT cl.chair_id
+FROM isu1.chair_locations cl
+  LEFT JOIN chair_distance_checkpoints cp ON cp.chair_id = cl.chair_id
+WHERE cl.created_at <= ?
+  AND (cp.last_location_id IS NULL OR cl.id > cp.last_location_id)
+`, cutoff); err != nil {
+		return fmt.Errorf("failed to select chairs to compact: %w", err)
+	}
+
+	for _, chairID := range chairIDs {
+		if err := compactChairLocationsOfChair(ctx, chairID, cutoff); err != nil {
+			return fmt.Errorf("failed to compact chair locations of %s: %w", chairID, err)
+		}
+	}
+	return nil
+}
+
+func compactChairLocationsOfChair(ctx context.Context, chairID string, cutoff time.Time) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// 複数インスタンスで同時に走ってもチェックポイント行のロックで直列化される
+	if _, err := tx.ExecContext(ctx, `INSERT INTO chair_distance_checkpoints (chair_id) VALUES (?) ON CONFLICT DO NOTHING`, chairID); err != nil {
+		return err
+	}
+	cp := &ChairDistanceCheckpoint{}
+	if err := tx.GetContext(ctx, cp, `SELECT * FROM chair_distance_checkpoints WHERE chair_id = ? FOR UPDATE`, chairID); err != nil {
+		return err
+	}
+
+	locations := []ChairLocation{}
+	if err := tx.SelectContext(ctx, &locations, `
+SELECT * FROM isu1.chair_locations
+WHERE chair_id = ? AND created_at <= ? AND id > ?
+ORDER BY id
+`, chairID, cutoff, cp.LastLocationID.String); err != nil {
+		return err
+	}
+	if len(locations) == 0 {
+		return nil
+	}
+
+	distance := 0
+	if cp.LastLocationID.Valid {
+		distance += calculateDistance(int(cp.LastLatitude.Int64), int(cp.LastLongitude.Int64), locations[0].Latitude, locations[0].Longitude)
+	}
+	for i := 1; i < len(locations); i++ {
+		distance += calculateDistance(locations[i-1].Latitude, locations[i-1].Longitude, locations[i].Latitude, locations[i].Longitude)
+	}
+	last := locations[len(locations)-1]
+
+	if _, err := tx.ExecContext(ctx, `
+UPDATE chair_distance_checkpoints
+SET total_distance = total_distance + ?, last_location_id = ?, last_latitude = ?, last_longitude = ?, checkpoint_at = ?
+WHERE chair_id = ?
+`, distance, last.ID, last.Latitude, last.Longitude, last.CreatedAt, chairID); err != nil {
+		return err
+	}
+
+	// チェックポイントに畳み込んだ区間のうち、バケットの先頭・ライドの境界・チェックポイントの点以外を削除する
+	if _, err := tx.ExecContext(ctx, `
+DELETE FROM isu1.chair_locations
+WHERE id IN (
+  SELECT id
+  FROM (SELECT id,
+      latitude,
+      longitude,
+      ROW_NUMBER() OVER (PARTITION BY FLOOR(EXTRACT(EPOCH FROM created_at) / ?) ORDER BY id) AS rn
+    FROM isu1.chair_locations
+    WHERE chair_id = ? AND id > ? AND id < ?) tmp
+  WHERE rn > 1
+    AND NOT EXISTS (SELECT 1
+      FROM rides
+      WHERE rides.chair_id = ?
+        AND ((rides.pickup_latitude = tmp.latitude AND rides.pickup_longitude = tmp.longitude)
+          OR (rides.destination_latitude = tmp.latitude AND rides.destination_longitude = tmp.longitude)))
+)
+`, chairLocationDownsampleInterval.Seconds(), chairID, cp.LastLocationID.String, last.ID, chairID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 椅子は曜日ごとの稼働時間帯を chair_schedules に登録できる。
+// 稼働時間帯が登録されている椅子は、CHAIR_SCHEDULE_INTERVAL ごとに時間帯に入ったら稼働、外れたら停止に切り替える。
+// 切り替えるのは時間帯の境界をまたいだときだけなので、時間帯の途中で手動で切り替えた状態は次の境界まで維持される
+var (
+	chairScheduleInterval = GetEnvDuration("CHAIR_SCHEDULE_INTERVAL", "1m")
+	chairScheduleLocation = mustLoadLocation(GetEnv("CHAIR_SCHEDULE_TIMEZONE", "Asia/Tokyo"))
+)
+
+func mustLoadLocation(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		panic(fmt.Sprintf("failed to load location %s: %v", name, err))
+	}
+	return loc
+}
+
+// start_minute >= end_minute の時間帯は日付をまたいで翌日の end_minute まで続く
+func (s *ChairSchedule) covers(t time.Time) bool {
+	weekday := int(t.Weekday())
+	minute := t.Hour()*60 + t.Minute()
+	if s.StartMinute < s.EndMinute {
+		return s.Weekday == weekday && s.StartMinute <= minute && minute < s.EndMinute
+	}
+	return (s.Weekday == weekday && s.StartMinute <= minute) ||
+		((s.Weekday+1)%7 == weekday && minute < s.EndMinute)
+}
+
+func inChairShift(schedules []ChairSchedule, now time.Time) bool {
+	now = now.In(chairScheduleLocation)
+	for _, s := range schedules {
+		if s.covers(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// "HH:MM" を0時からの分に変換する。終了時刻として "24:00" も受け付ける
+func parseScheduleMinute(v string) (int, error) {
+	h, m, ok := strings.Cut(v, ":")
+	if !ok {
+		return 0, fmt.Errorf("invalid time: %s", v)
+	}
+	hour, err := strconv.Atoi(h)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time: %s", v)
+	}
+	minute, err := strconv.Atoi(m)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time: %s", v)
+	}
+	if hour < 0 || minute < 0 || minute >= 60 || hour*60+minute > 24*60 {
+		return 0, fmt.Errorf("invalid time: %s", v)
+	}
+	return hour*60 + minute, nil
+}
+
+func formatScheduleMinute(minute int) string {
+	return fmt.Sprintf("%02d:%02d", minute/60, minute%60)
+}
+
+func getChairSchedules(ctx context.Context, q sqlx.QueryerContext, chairID string) ([]ChairSchedule, error) {
+	schedules := []ChairSchedule{}
+	if err := sqlx.SelectContext(ctx, q, &schedules, `SELECT * FROM chair_schedules WHERE chair_id = ? ORDER BY weekday, start_minute`, chairID); err != nil {
+		return nil, err
+	}
+	return schedules, nil
+}
+
+func replaceChairSchedules(ctx context.Context, tx *sqlx.Tx, chairID string, schedules []ChairSchedule) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM chair_schedules WHERE chair_id = ?`, chairID); err != nil {
+		return err
+	}
+	// 次の巡回で現在の時間帯に合わせて切り替え直す
+	if _, err := tx.ExecContext(ctx, `DELETE FROM chair_schedule_states WHERE chair_id = ?`, chairID); err != nil {
+		return err
+	}
+	for _, s := range schedules {
+		if _, err := tx.ExecContext(
+			ctx,
+			`INSERT INTO chair_schedules (chair_id, weekday, start_minute, end_minute) VALUES (?, ?, ?, ?)`,
+			chairID, s.Weekday, s.StartMinute, s.EndMinute,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// go startChairScheduler()
+func startChairScheduler() {
+	if chairScheduleInterval <= 0 {
+		slog.Info("chair scheduler is disabled")
+		return
+	}
+	t := NewTicker(int(chairScheduleInterval.Milliseconds()), func() {
+		if err := applyChairSchedules(context.Background(), time.Now()); err != nil {
+			slog.Error("failed to apply chair schedules", slog.Any("error", err))
+		}
+	})
+	t.Start()
+}
+
+func applyChairSchedules(ctx context.Context, now time.Time) error {
+	ctx, span := tracer.Start(ctx, "applyChairSchedules")
+	defer span.End()
+
+	chairIDs := []string{}
+	if err := db.SelectContext(ctx, &chairIDs, `SELECT DISTINCT chair_id FROM chair_schedules`); err != nil {
+		return fmt.Errorf("failed to select scheduled chairs: %w", err)
+	}
+	for _, chairID := range chairIDs {
+		if err := applyChairSchedule(ctx, chairID, now); err != nil {
+			return fmt.Errorf("failed to apply schedule of chair %s: %w", chairID, err)
+		}
+	}
+	return nil
+}
+
+func applyChairSchedule(ctx context.Context, chairID string, now time.Time) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// 複数インスタンスで同時に走っても状態行のロックで直列化される
+	if _, err := tx.ExecContext(ctx, `INSERT INTO chair_schedule_states (chair_id) VALUES (?) ON CONFLICT DO NOTHING`, chairID); err != nil {
+		return err
+	}
+	state := &ChairScheduleState{}
+	if err := tx.GetContext(ctx, state, `SELECT * FROM chair_schedule_states WHERE chair_id = ? FOR UPDATE SKIP LOCKED`, chairID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+
+	schedules, err := getChairSchedules(ctx, tx, chairID)
+	if err != nil {
+		return err
+	}
+	inShift := inChairShift(schedules, now)
+	if state.InShift.Valid && state.InShift.Bool == inShift {
+		return nil
+	}
+
+	deferred, err := setChairActivity(ctx, tx, chairID, inShift)
+	if err != nil {
+		return err
+	}
+	if deferred {
+		slog.Info("chair deactivation is deferred until the ride completes", slog.String("chair_id", chairID))
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE chair_schedule_states SET in_shift = ?, updated_at = CURRENT_TIMESTAMP(6) WHERE chair_id = ?`, inShift, chairID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if !deferred {
+		invalidateSubjectCache(ctx, sessionRoleChair, chairID)
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/samber/lo"
+)
+
+// 椅子の総移動距離はRedisで管理する。
+// chair_locations を id(ULID) 順に並べたときの隣接2点間のマンハッタン距離の総和を総移動距離とし、
+// Redis側は最後に反映した点(id, 緯度, 経度)を持っておき、それより新しい点だけを反映する。
+// 同じ点を二度反映しても加算されない。反映し損ねた点は後から反映されず、次の点との距離は最後に反映した点から測るので
+// その分だけ短くなる。ずれは verify-total-distance -repair でDBから計算し直して直す。
+
+func chairTotalDistanceKey(chairID string) string {
+	return fmt.Sprintf("chair:%s:total_distance", chairID)
+}
+
+func chairTotalDistanceUpdatedAtKey(chairID string) string {
+	return fmt.Sprintf("chair:%s:total_distance_updated_at", chairID)
+}
+
+func chairTotalDistanceLastLocationKey(chairID string) string {
+	return fmt.Sprintf("chair:%s:total_distance_last_location", chairID)
+}
+
+func chairTotalDistanceKeys(chairID string) []string {
+	return []string{
+		chairTotalDistanceKey(chairID),
+		chairTotalDistanceUpdatedAtKey(chairID),
+		chairTotalDistanceLastLocationKey(chairID),
+	}
+}
+
+// KEYS: total_distance, total_distance_updated_at, total_distance_last_location
+// ARGV: location_id, latitude, longitude, updated_at
+var applyChairLocationScript = redis.NewScript(`
+local last = redis.call('HMGET', KEYS[3], 'id', 'latitude', 'longitude')
+if last[1] and last[1] >= ARGV[1] then
+  return 0
+end
+if last[1] then
+  local distance = math.abs(tonumber(ARGV[2]) - tonumber(last[2])) + math.abs(tonumber(ARGV[3]) - tonumber(last[3]))
+  redis.call('INCRBY', KEYS[1], distance)
+else
+  redis.call('SET', KEYS[1], 0, 'NX')
+end
+redis.call('SET', KEYS[2], ARGV[4])
+redis.call('HSET', KEYS[3], 'id', ARGV[1], 'latitude', ARGV[2], 'longitude', ARGV[3])
+return 1
+`)
+
+// KEYS: total_distance, total_distance_updated_at, total_distance_last_location
+// ARGV: total_distance, updated_at, location_id, latitude, longitude
+// 計算中により新しい点が反映されていたら上書きしない
+var setChairTotalDistanceScript = redis.NewScript(`
+local lastID = redis.call('HGET', KEYS[3], 'id')
+if lastID and ARGV[3] ~= '' and lastID > ARGV[3] then
+  return 0
+end
+redis.call('SET', KEYS[1], ARGV[1])
+redis.call('SET', KEYS[2], ARGV[2])
+if ARGV[3] == '' then
+  redis.call('DEL', KEYS[3])
+else
+  redis.call('HSET', KEYS[3], 'id', ARGV[3], 'latitude', ARGV[4], 'longitude', ARGV[5])
+end
+return 1
+`)
+
+// 記録した位置情報を総移動距離に反映する。location.ID に対して冪等
+func applyChairLocationToTotalDistance(ctx context.Context, location *ChairLocation) error {
+	if err := applyChairLocationScript.Run(
+		ctx,
+		rdb,
+		chairTotalDistanceKeys(location.ChairID),
+		location.ID, location.Latitude, location.Longitude, location.CreatedAt.UnixMilli(),
+	).Err(); err != nil {
+		return fmt.Errorf("failed to apply chair location to total distance: %w", err)
+	}
+	return nil
+}
+
+// 反映されたらtrue、より新しい点がすでに反映されていて上書きしなかったらfalse
+func setChairTotalDistance(ctx context.Context, d *chairTotalDistanceFromDB) (bool, error) {
+	var updatedAt int64
+	if d.TotalDistanceUpdatedAt.Valid {
+		updatedAt = d.TotalDistanceUpdatedAt.Time.UnixMilli()
+	}
+	applied, err := setChairTotalDistanceScript.Run(
+		ctx,
+		rdb,
+		chairTotalDistanceKeys(d.ID),
+		d.TotalDistance, updatedAt, d.LastLocationID.String, d.LastLatitude.Int64, d.LastLongitude.Int64,
+	).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to set total distance: %w", err)
+	}
+	return applied == 1, nil
+}
+
+type chairTotalDistance struct {
+	ChairID       string
+	TotalDistance int
+	UpdatedAt     int64
+}
+
+func getChairsTotalDistances(ctx context.Context, chairIDs []string) (map[string]*chairTotalDistance, error) {
+	keys := lo.FlatMap(chairIDs, func(id string, _ int) []string {
+		return []string{
+			chairTotalDistanceKey(id),
+			chairTotalDistanceUpdatedAtKey(id),
+		}
+	})
+	result := rdb.MGet(ctx, keys...)
+	if err := result.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get total distances: %w", err)
+	}
+	chairTotalDistances := make(map[string]*chairTotalDistance, len(chairIDs))
+	vals := result.Val()
+	for i := 0; i < len(keys); i += 2 {
+		if vals[i] == nil {
+			continue
+		}
+		distance, err := strconv.Atoi(vals[i].(string))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse total distance: %w", err)
+		}
+		var updatedAt int64
+		if vals[i+1] != nil {
+			updatedAt, err = strconv.ParseInt(vals[i+1].(string), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse total distance updated at: %w", err)
+			}
+		}
+		chairTotalDistances[chairIDs[i/2]] = &chairTotalDistance{
+			ChairID:       chairIDs[i/2],
+			TotalDistance: distance,
+			UpdatedAt:     updatedAt,
+		}
+	}
+	return chairTotalDistances, nil
+}
+
+type chairTotalDistanceFromDB struct {
+	ID                     string         `db:"id"`
+	TotalDistance          int            `db:"total_distance"`
+	TotalDistanceUpdatedAt sql.NullTime   `db:"total_distance_updated_at"`
+	LastLocationID         sql.NullString `db:"last_location_id"`
+	LastLatitude           sql.NullInt64  `db:"last_latitude"`
+	LastLongitude          sql.NullInt64  `db:"last_longitude"`
+}
+
+// DBから全椅子の総移動距離を計算する。
+// 間引き済みの区間はチェックポイントに畳み込まれているので、チェックポイント + それ以降の点で計算する
+func selectChairsTotalDistanceFromDB(ctx context.Context) ([]chairTotalDistanceFromDB, error) {
+	var chairs []chairTotalDistanceFromDB
+	if err := db.SelectContext(ctx, &chairs, `
+SELECT chairs.id,
+  COALESCE(cp.total_distance, 0) + COALESCE(distance_table.total_distance, 0) AS total_distance,
+  distance_table.total_distance_updated_at,
+  last_location.id AS last_location_id,
+  last_location.latitude AS last_latitude,
+  last_location.longitude AS last_longitude
+FROM isu1.chairs
+  LEFT JOIN chair_distance_checkpoints cp ON cp.chair_id = chairs.id
+  LEFT JOIN (SELECT chair_id,
+    SUM(COALESCE(distance, 0)) AS total_distance,
+    MAX(created_at)          AS total_distance_updated_at
+  FROM (SELECT chair_id,
+    created_at,
+    ABS(latitude - LAG(latitude) OVER (PARTITION BY chair_id ORDER BY id)) +
+    ABS(longitude - LAG(longitude) OVER (PARTITION BY chair_id ORDER BY id)) AS distance
+    FROM (SELECT cl.id, cl.chair_id, cl.latitude, cl.longitude, cl.created_at
+      FROM isu1.chair_locations cl
+        LEFT JOIN chair_distance_checkpoints cp ON cp.chair_id = cl.chair_id
+      WHERE cp.last_location_id IS NULL OR cl.id > cp.last_location_id
+      UNION ALL
+      SELECT last_location_id, chair_id, last_latitude, last_longitude, checkpoint_at
+      FROM chair_distance_checkpoints
+      WHERE last_location_id IS NOT NULL) points) tmp
+  GROUP BY chair_id) distance_table ON distance_table.chair_id = chairs.id
+  LEFT JOIN (SELECT DISTINCT ON (chair_id) chair_id, id, latitude, longitude
+    FROM isu1.chair_locations
+    ORDER BY chair_id, id DESC) last_location ON last_location.chair_id = chairs.id
+`); err != nil {
+		return nil, fmt.Errorf("failed to select chairs total distance: %w", err)
+	}
+	return chairs, nil
+}
+
+func initializeChairsTotalDistance(ctx context.Context) error {
+	chairs, err := selectChairsTotalDistanceFromDB(ctx)
+	if err != nil {
+		return err
+	}
+	for _, chair := range chairs {
+		if _, err := setChairTotalDistance(ctx, &chair); err != nil {
+			return fmt.Errorf("failed to set chair total distance: %w", err)
+		}
+	}
+	return nil
+}
+
+type chairTotalDistanceDrift struct {
+	ChairID  string
+	Expected int
+	Actual   *int
+	Repaired bool
+}
+
+// Redisの総移動距離をDBから再計算した値と突き合わせ、ずれている椅子を返す。repairがtrueなら修正もする
+func verifyChairsTotalDistance(ctx context.Context, repair bool) ([]chairTotalDistanceDrift, error) {
+	chairs, err := selectChairsTotalDistanceFromDB(ctx)
+	if err != nil {
+		return nil, err
+	}
+	chairIDs := lo.Map(chairs, func(c chairTotalDistanceFromDB, _ int) string { return c.ID })
+	actuals, err := getChairsTotalDistances(ctx, chairIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	drifts := []chairTotalDistanceDrift{}
+	for _, chair := range chairs {
+		drift := chairTotalDistanceDrift{
+			ChairID:  chair.ID,
+			Expected: chair.TotalDistance,
+		}
+		if actual, ok := actuals[chair.ID]; ok {
+			if actual.TotalDistance == chair.TotalDistance {
+				continue
+			}
+			drift.Actual = &actual.TotalDistance
+		}
+		if repair {
+			drift.Repaired, err = setChairTotalDistance(ctx, &chair)
+			if err != nil {
+				return nil, err
+			}
+		}
+		drifts = append(drifts, drift)
+	}
+	return drifts, nil
+}
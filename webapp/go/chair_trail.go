@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type trailPoint struct {
+	Latitude   int   `json:"latitude"`
+	Longitude  int   `json:"longitude"`
+	RecordedAt int64 `json:"recorded_at"`
+}
+
+type chairTrailResponse struct {
+	ChairID string       `json:"chair_id"`
+	Points  []trailPoint `json:"points"`
+}
+
+// GeoJSONの座標は [経度, 緯度] の順
+type geoJSONLineString struct {
+	Type        string   `json:"type"`
+	Coordinates [][2]int `json:"coordinates"`
+}
+
+type geoJSONFeature struct {
+	Type       string             `json:"type"`
+	Geometry   *geoJSONLineString `json:"geometry"`
+	Properties map[string]any     `json:"properties"`
+}
+
+// 椅子の位置履歴を古い順に取得する。ORDER BY id はULIDなので記録順と一致する
+func selectChairTrail(ctx context.Context, q sqlx.QueryerContext, chairID string, since, until time.Time) ([]ChairLocation, error) {
+	_, span := tracer.Start(ctx, "selectChairTrail")
+	defer span.End()
+
+	locations := []ChairLocation{}
+	if err := sqlx.SelectContext(
+		ctx,
+		q,
+		&locations,
+		`SELECT * FROM isu1.chair_locations WHERE chair_id = ? AND created_at BETWEEN ? AND ? ORDER BY id`,
+		chairID, since, until,
+	); err != nil {
+		return nil, fmt.Errorf("failed to select chair locations: %w", err)
+	}
+	return locations, nil
+}
+
+// ?name=<unix milli> を読む。未指定ならdefを返す
+func parseUnixMilliQuery(r *http.Request, name string, def time.Time) (time.Time, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	parsed, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s is invalid: %w", name, err)
+	}
+	return time.UnixMilli(parsed), nil
+}
+
+// ?format=geojson ならGeoJSONのLineString Featureとして、それ以外は点列として返す
+func writeChairTrail(w http.ResponseWriter, r *http.Request, chairID string, locations []ChairLocation, properties map[string]any) {
+	if r.URL.Query().Get("format") == "geojson" {
+		writeGeoJSON(w, http.StatusOK, chairTrailFeature(chairID, locations, properties))
+		return
+	}
+
+	points := make([]trailPoint, 0, len(locations))
+	for _, l := range locations {
+		points = append(points, trailPoint{
+			Latitude:   l.Latitude,
+			Longitude:  l.Longitude,
+			RecordedAt: l.CreatedAt.UnixMilli(),
+		})
+	}
+	writeJSON(w, http.StatusOK, &chairTrailResponse{
+		ChairID: chairID,
+		Points:  points,
+	})
+}
+
+func chairTrailFeature(chairID string, locations []ChairLocation, properties map[string]any) *geoJSONFeature {
+	props := map[string]any{"chair_id": chairID}
+	for k, v := range properties {
+		props[k] = v
+	}
+	recordedAt := make([]int64, 0, len(locations))
+	coordinates := make([][2]int, 0, len(locations))
+	for _, l := range locations {
+		recordedAt = append(recordedAt, l.CreatedAt.UnixMilli())
+		coordinates = append(coordinates, [2]int{l.Longitude, l.Latitude})
+	}
+	props["recorded_at"] = recordedAt
+
+	feature := &geoJSONFeature{
+		Type:       "Feature",
+		Properties: props,
+	}
+	// LineStringは2点以上必要なので、それ未満ならgeometryはnullにする
+	if len(coordinates) >= 2 {
+		feature.Geometry = &geoJSONLineString{
+			Type:        "LineString",
+			Coordinates: coordinates,
+		}
+	}
+	return feature
+}
+
+func writeGeoJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/geo+json;charset=utf-8")
+	buf, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(statusCode)
+	w.Write(buf)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// ./isuride <command> [flags] で運用向けのコマンドを実行する
+func runCommand(name string, args []string) {
+	_db, err := GetDB()
+	if err != nil {
+		panic(err)
+	}
+	db = _db
+	rdb = GetRedisClient(context.Background())
+
+	switch name {
+	case "verify-total-distance":
+		os.Exit(commandVerifyTotalDistance(args))
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n", name)
+		os.Exit(2)
+	}
+}
+
+// Redisの椅子の総移動距離をDBから再計算した値と比較する。-repair でずれを修正する
+func commandVerifyTotalDistance(args []string) int {
+	fs := flag.NewFlagSet("verify-total-distance", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "repair drifted total distances")
+	fs.Parse(args)
+
+	drifts, err := verifyChairsTotalDistance(context.Background(), *repair)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to verify total distance: %v\n", err)
+		return 1
+	}
+
+	unrepaired := 0
+	for _, d := range drifts {
+		actual := "missing"
+		if d.Actual != nil {
+			actual = fmt.Sprintf("%d", *d.Actual)
+		}
+		status := "drift"
+		if d.Repaired {
+			status = "repaired"
+		} else {
+			unrepaired++
+		}
+		fmt.Printf("%s\tchair_id=%s\texpected=%d\tactual=%s\n", status, d.ChairID, d.Expected, actual)
+	}
+	fmt.Printf("%d chairs drifted, %d repaired\n", len(drifts), len(drifts)-unrepaired)
+
+	if unrepaired > 0 {
+		return 1
+	}
+	return 0
+}
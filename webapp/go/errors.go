@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/isucon/isucon14/webapp/go/validate"
+)
+
+// エラーレスポンスの code はクライアントが分岐に使う機械向けの値で、message と違って変えない。
+// withErrorCode で付けたものがあればそれを、無ければステータスコードから作った値(404 なら not_found)を返す
+const (
+	errCodeInvalidJSON          = "invalid_json"
+	errCodeValidationFailed     = "validation_failed"
+	errCodeUsernameTaken        = "username_taken"
+	errCodeActiveRides          = "active_rides_exist"
+	errCodeRateLimited          = "rate_limited"
+	errCodeIdempotencyInFlight  = "idempotency_key_in_flight"
+	errCodeIdempotencyKeyReused = "idempotency_key_reused"
+)
+
+type codedError struct {
+	code string
+	err  error
+}
+
+func (e *codedError) Error() string { return e.err.Error() }
+func (e *codedError) Unwrap() error { return e.err }
+
+func withErrorCode(code string, err error) error {
+	return &codedError{code: code, err: err}
+}
+
+type errorResponse struct {
+	Code    string                `json:"code"`
+	Message string                `json:"message"`
+	Errors  []validate.FieldError `json:"errors,omitempty"` // 入力の検証に失敗したフィールド
+}
+
+func newErrorResponse(statusCode int, err error) *errorResponse {
+	res := &errorResponse{Message: err.Error()}
+	var ce *codedError
+	var ve validate.Errors
+	switch {
+	case errors.As(err, &ce):
+		res.Code = ce.code
+	case errors.As(err, &ve):
+		res.Code = errCodeValidationFailed
+	default:
+		res.Code = strings.ReplaceAll(strings.ToLower(http.StatusText(statusCode)), " ", "_")
+	}
+	if errors.As(err, &ve) {
+		res.Errors = ve
+	}
+	return res
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/samber/lo"
+)
+
+// 評価には任意でコメントと定型のタグを付けられる。評価値は従来通り rides.evaluation に持ち、
+// コメントは evaluation_comments、タグは evaluation_tags に保存する。
+// コメントは投稿時に禁止語を含んでいれば HIDDEN にし、オーナーが通報したものは FLAGGED にする。
+// オーナーに見せるのは VISIBLE のコメントだけ
+var bannedWords = lo.Filter(
+	strings.Split(GetEnv("EVALUATION_BANNED_WORDS", "死ね,殺す,バカ,fuck,shit"), ","),
+	func(w string, _ int) bool { return w != "" },
+)
+
+const maxEvaluationCommentLength = 500
+
+var evaluationTags = []string{
+	"clean",
+	"on_time",
+	"comfortable",
+	"friendly",
+	"dirty",
+	"late",
+	"rude",
+	"unsafe",
+}
+
+func validateEvaluationDetail(comment *string, tags []string) error {
+	if comment != nil && utf8.RuneCountInString(*comment) > maxEvaluationCommentLength {
+		return fmt.Errorf("comment must be at most %d characters", maxEvaluationCommentLength)
+	}
+	for _, tag := range tags {
+		if !lo.Contains(evaluationTags, tag) {
+			return fmt.Errorf("unknown tag: %s", tag)
+		}
+	}
+	return nil
+}
+
+func containsBannedWord(comment string) bool {
+	lower := strings.ToLower(comment)
+	for _, w := range bannedWords {
+		if strings.Contains(lower, strings.ToLower(w)) {
+			return true
+		}
+	}
+	return false
+}
+
+func insertEvaluationDetail(ctx context.Context, tx *sqlx.Tx, ride *Ride, comment *string, tags []string) error {
+	if comment != nil && strings.TrimSpace(*comment) != "" {
+		status := "VISIBLE"
+		if containsBannedWord(*comment) {
+			status = "HIDDEN"
+		}
+		if _, err := tx.ExecContext(
+			ctx,
+			`INSERT INTO evaluation_comments (ride_id, chair_id, comment, moderation_status) VALUES (?, ?, ?, ?)`,
+			ride.ID, ride.ChairID.String, *comment, status,
+		); err != nil {
+			return fmt.Errorf("failed to insert evaluation comment: %w", err)
+		}
+	}
+	for _, tag := range lo.Uniq(tags) {
+		if _, err := tx.ExecContext(
+			ctx,
+			`INSERT INTO evaluation_tags (ride_id, chair_id, tag) VALUES (?, ?, ?)`,
+			ride.ID, ride.ChairID.String, tag,
+		); err != nil {
+			return fmt.Errorf("failed to insert evaluation tag: %w", err)
+		}
+	}
+	return nil
+}
+
+type chairEvaluation struct {
+	RideID      string    `db:"ride_id"`
+	Evaluation  int       `db:"evaluation"`
+	Comment     *string   `db:"comment"`
+	EvaluatedAt time.Time `db:"evaluated_at"`
+	Tags        []string  `db:"-"`
+}
+
+// 椅子の評価を新しい順に返す。コメントは VISIBLE のものだけ
+func selectChairEvaluations(ctx context.Context, q sqlx.QueryerContext, chairID string, limit int) ([]chairEvaluation, error) {
+	evaluations := []chairEvaluation{}
+	if err := sqlx.SelectContext(ctx, q, &evaluations, `
+SELECT rides.id AS ride_id,
+  rides.evaluation,
+  CASE WHEN evaluation_comments.moderation_status = 'VISIBLE' THEN evaluation_comments.comment END AS comment,
+  rides.updated_at AS evaluated_at
+FROM rides
+  LEFT JOIN evaluation_comments ON evaluation_comments.ride_id = rides.id
+WHERE rides.chair_id = ? AND rides.evaluation IS NOT NULL
+ORDER BY rides.id DESC
+LIMIT ?
+`, chairID, limit); err != nil {
+		return nil, fmt.Errorf("failed to select chair evaluations: %w", err)
+	}
+	if len(evaluations) == 0 {
+		return evaluations, nil
+	}
+
+	query, args, err := sqlx.In(
+		`SELECT ride_id, tag FROM evaluation_tags WHERE ride_id IN (?) ORDER BY ride_id, tag`,
+		lo.Map(evaluations, func(e chairEvaluation, _ int) string { return e.RideID }),
+	)
+	if err != nil {
+		return nil, err
+	}
+	type rideTag struct {
+		RideID string `db:"ride_id"`
+		Tag    string `db:"tag"`
+	}
+	tags := []rideTag{}
+	if err := sqlx.SelectContext(ctx, q, &tags, query, args...); err != nil {
+		return nil, fmt.Errorf("failed to select evaluation tags: %w", err)
+	}
+	tagsByRide := map[string][]string{}
+	for _, t := range tags {
+		tagsByRide[t.RideID] = append(tagsByRide[t.RideID], t.Tag)
+	}
+	for i := range evaluations {
+		evaluations[i].Tags = tagsByRide[evaluations[i].RideID]
+		if evaluations[i].Tags == nil {
+			evaluations[i].Tags = []string{}
+		}
+	}
+	return evaluations, nil
+}
+
+// 椅子に付いたタグの件数。一度も付いていないタグは0件として含める
+func selectChairEvaluationTagCounts(ctx context.Context, q sqlx.QueryerContext, chairID string) (map[string]int, error) {
+	type tagCount struct {
+		Tag   string `db:"tag"`
+		Count int    `db:"count"`
+	}
+	rows := []tagCount{}
+	if err := sqlx.SelectContext(ctx, q, &rows, `SELECT tag, COUNT(*) AS count FROM evaluation_tags WHERE chair_id = ? GROUP BY tag`, chairID); err != nil {
+		return nil, fmt.Errorf("failed to select evaluation tag counts: %w", err)
+	}
+	counts := make(map[string]int, len(evaluationTags))
+	for _, tag := range evaluationTags {
+		counts[tag] = 0
+	}
+	for _, r := range rows {
+		counts[r.Tag] = r.Count
+	}
+	return counts, nil
+}
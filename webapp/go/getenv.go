@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"os"
+	"strconv"
+	"time"
 )
 
 func GetEnv(key, val string) string {
@@ -14,3 +16,27 @@ func GetEnv(key, val string) string {
 		return v
 	}
 }
+
+func GetEnvDuration(key, val string) time.Duration {
+	d, err := time.ParseDuration(GetEnv(key, val))
+	if err != nil {
+		panic(fmt.Sprintf("failed to parse %s as duration: %v", key, err))
+	}
+	return d
+}
+
+func GetEnvInt(key, val string) int {
+	i, err := strconv.Atoi(GetEnv(key, val))
+	if err != nil {
+		panic(fmt.Sprintf("failed to parse %s as int: %v", key, err))
+	}
+	return i
+}
+
+func GetEnvFloat(key, val string) float64 {
+	f, err := strconv.ParseFloat(GetEnv(key, val), 64)
+	if err != nil {
+		panic(fmt.Sprintf("failed to parse %s as float: %v", key, err))
+	}
+	return f
+}
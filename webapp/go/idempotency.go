@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// POST に Idempotency-Key ヘッダーが付いていれば、最初のリクエストの応答(ステータスと本文)を Redis に
+// IDEMPOTENCY_TTL の間保存し、同じキーで再送されたリクエストには処理をせずにその応答を返す。
+// キーは認証した主体ごとに別で、同じキーで本文が違うリクエストは 422 にする。
+// 最初のリクエストの処理中に届いた再送は IDEMPOTENCY_WAIT まで完了を待ち、それでも終わらなければ 409 を返す。
+// 処理中の印は IDEMPOTENCY_LOCK_TTL で消えるので、途中で落ちても再送できる。
+// 5xx の応答は保存せず、再送されたら処理し直す
+var (
+	idempotencyTTL     = GetEnvDuration("IDEMPOTENCY_TTL", "24h")
+	idempotencyLockTTL = GetEnvDuration("IDEMPOTENCY_LOCK_TTL", "30s")
+	idempotencyWait    = GetEnvDuration("IDEMPOTENCY_WAIT", "5s")
+)
+
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	idempotencyMaxKeyLength   = 255
+	idempotencyPollInterval   = 50 * time.Millisecond
+	idempotencyStateInFlight  = "in_flight"
+	idempotencyStateCompleted = "completed"
+)
+
+type idempotencyRecord struct {
+	State       string `json:"state"`
+	Fingerprint string `json:"fingerprint"` // リクエスト本文の SHA-256
+	Status      int    `json:"status,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        []byte `json:"body,omitempty"`
+}
+
+// 処理した応答を本文ごと控えておく
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *idempotencyRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *idempotencyRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// 認証ミドルウェアの後ろに置く
+func idempotencyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if r.Method != http.MethodPost || key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := r.Context()
+		_, span := tracer.Start(ctx, "idempotencyMiddleware")
+		defer span.End()
+
+		if len(key) > idempotencyMaxKeyLength {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("%s must be at most %d characters", idempotencyKeyHeader, idempotencyMaxKeyLength))
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(body)
+		fingerprint := hex.EncodeToString(sum[:])
+
+		redisKey := fmt.Sprintf("idempotency:%s:%s:%s", requestIdentity(r), r.URL.Path, key)
+		for {
+			acquired, err := acquireIdempotencyKey(ctx, redisKey, fingerprint)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if acquired {
+				break
+			}
+			if replayIdempotentResponse(w, r, redisKey, fingerprint) {
+				return
+			}
+		}
+
+		rec := &idempotencyRecorder{ResponseWriter: w}
+		completed := false
+		defer func() {
+			// 途中で panic したときや 5xx のときは印を消して再送で処理し直せるようにする
+			if !completed {
+				if err := rdb.Del(context.WithoutCancel(ctx), redisKey).Err(); err != nil {
+					slog.ErrorContext(ctx, "failed to release idempotency key", slog.Any("error", err))
+				}
+			}
+		}()
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 || rec.status >= 500 {
+			return
+		}
+		record := &idempotencyRecord{
+			State:       idempotencyStateCompleted,
+			Fingerprint: fingerprint,
+			Status:      rec.status,
+			ContentType: rec.Header().Get("Content-Type"),
+			Body:        rec.body.Bytes(),
+		}
+		payload, err := json.Marshal(record)
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to marshal idempotency record", slog.Any("error", err))
+			return
+		}
+		if err := rdb.Set(context.WithoutCancel(ctx), redisKey, payload, idempotencyTTL).Err(); err != nil {
+			slog.ErrorContext(ctx, "failed to save idempotency record", slog.Any("error", err))
+			return
+		}
+		completed = true
+	})
+}
+
+// 処理中の印を置けたら true
+func acquireIdempotencyKey(ctx context.Context, redisKey, fingerprint string) (bool, error) {
+	payload, err := json.Marshal(&idempotencyRecord{State: idempotencyStateInFlight, Fingerprint: fingerprint})
+	if err != nil {
+		return false, err
+	}
+	return rdb.SetNX(ctx, redisKey, payload, idempotencyLockTTL).Result()
+}
+
+// 保存した応答を返す。処理中なら完了を待つ。
+// 最初のリクエストが失敗して印が消えていたら何も返さずに false を返すので、呼び出し側で処理し直す
+func replayIdempotentResponse(w http.ResponseWriter, r *http.Request, redisKey, fingerprint string) bool {
+	ctx := r.Context()
+	deadline := time.Now().Add(idempotencyWait)
+	for {
+		record := &idempotencyRecord{}
+		payload, err := rdb.Get(ctx, redisKey).Bytes()
+		if errors.Is(err, redis.Nil) {
+			return false
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return true
+		}
+		if err := json.Unmarshal(payload, record); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return true
+		}
+		if record.Fingerprint != fingerprint {
+			writeError(w, http.StatusUnprocessableEntity, withErrorCode(errCodeIdempotencyKeyReused, fmt.Errorf("%s was already used for a different request", idempotencyKeyHeader)))
+			return true
+		}
+		if record.State == idempotencyStateCompleted {
+			if record.ContentType != "" {
+				w.Header().Set("Content-Type", record.ContentType)
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(record.Status)
+			w.Write(record.Body)
+			return true
+		}
+		if time.Now().After(deadline) {
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusConflict, withErrorCode(errCodeIdempotencyInFlight, errors.New("a request with the same idempotency key is in progress")))
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return true
+		case <-time.After(idempotencyPollInterval):
+		}
+	}
+}
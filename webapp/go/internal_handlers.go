@@ -3,6 +3,7 @@ package main
 import (
 	"database/sql"
 	"errors"
+	"log/slog"
 	"net/http"
 )
 
@@ -12,9 +13,9 @@ func internalGetMatching(w http.ResponseWriter, r *http.Request) {
 	_, span := tracer.Start(ctx, "internalGetMatching")
 	defer span.End()
 
-	// MEMO: 一旦最も待たせているリクエストに適当な空いている椅子マッチさせる実装とする。おそらくもっといい方法があるはず…
+	// 最も待たせているリクエストから順に、配車位置に近い空き椅子へオファーを出す
 	ride := &Ride{}
-	if err := db.GetContext(ctx, ride, `SELECT * FROM rides WHERE chair_id IS NULL ORDER BY created_at LIMIT 1`); err != nil {
+	if err := db.GetContext(ctx, ride, `SELECT * FROM rides WHERE chair_id IS NULL AND status = 'MATCHING' ORDER BY COALESCE(pickup_at, created_at) LIMIT 1`); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			w.WriteHeader(http.StatusNoContent)
 			return
@@ -25,20 +26,66 @@ func internalGetMatching(w http.ResponseWriter, r *http.Request) {
 	tx, err := db.BeginTxx(ctx, nil)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
+		return
 	}
-	var matchedChairID string
+	defer tx.Rollback()
+
+	// 評価の低い乗客は上位モデルの椅子にマッチングしない
+	userStats, err := getUserStats(ctx, tx, ride.UserID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	excludePremium := userStats.isLowRated()
+
+	// 相乗りを許可したライドは、まず相乗りできる走行中の椅子を探す
+	if ride.Pooled {
+		candidate, err := findPooledRideCandidate(ctx, tx, ride, excludePremium)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if candidate != nil {
+			sharedDistance := calculateDistance(ride.PickupLatitude, ride.PickupLongitude, candidate.DestinationLatitude, candidate.DestinationLongitude)
+			if _, err := tx.ExecContext(ctx, "UPDATE rides SET chair_id = ?, pooled_with = ?, pool_discount = ?, updated_at = CURRENT_TIMESTAMP(6) WHERE id = ?", candidate.ChairID, candidate.ID, calculatePoolDiscount(ride, sharedDistance), ride.ID); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if _, err := tx.ExecContext(ctx, "UPDATE rides SET pooled_with = ?, pool_discount = ? WHERE id = ?", ride.ID, calculatePoolDiscount(&candidate.Ride, sharedDistance), candidate.ID); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if err := insertRideAssignment(ctx, tx, ride.ID, candidate.ChairID.String); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if err := tx.Commit(); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if err := addChairOfferCount(ctx, candidate.ChairID.String, "offered"); err != nil {
+				slog.ErrorContext(ctx, "internalGetMatching: failed to add offer count", slog.Any("error", err), slog.String("chair_id", candidate.ChairID.String))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
 	// if err := tx.GetContext(ctx, &matchedChairID, "SELECT chair_id FROM vacant_chair FOR UPDATE SKIP LOCKED LIMIT 1"); err != nil && !errors.Is(err, sql.ErrNoRows) {
 	// 	writeError(w, http.StatusInternalServerError, err)
 	// 	return
 	// }
 
-	if err := tx.GetContext(ctx, &matchedChairID, "DELETE FROM vacant_chair WHERE CTID = (SELECT CTID FROM vacant_chair FOR UPDATE SKIP LOCKED LIMIT 1) RETURNING chair_id"); err != nil && !errors.Is(err, sql.ErrNoRows) {
+	// 空き椅子のうち配車位置に最も近い椅子にオファーを出す。ゾーンや過去に断った椅子の除外は popBestVacantChair で行う
+	matchedChairID, err := popBestVacantChair(ctx, tx, ride, excludePremium)
+	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
 	if matchedChairID == "" {
 		w.WriteHeader(http.StatusNoContent)
+		return
 	}
 	/*
 		empty := false
@@ -69,6 +116,10 @@ func internalGetMatching(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	if err := insertRideAssignment(ctx, tx, ride.ID, matchedChairID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
 	// if _, err := tx.ExecContext(ctx, "DELETE FROM vacant_chair WHERE chair_id = ?", matchedChairID); err != nil {
 	// 	writeError(w, http.StatusInternalServerError, err)
 	// 	return
@@ -77,6 +128,9 @@ func internalGetMatching(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	if err := addChairOfferCount(ctx, matchedChairID, "offered"); err != nil {
+		slog.ErrorContext(ctx, "internalGetMatching: failed to add offer count", slog.Any("error", err), slog.String("chair_id", matchedChairID))
+	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -3,16 +3,18 @@ package main
 import (
 	"context"
 	crand "crypto/rand"
-	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"os"
 	"os/exec"
 	"runtime"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/isucon/isucon14/webapp/go/validate"
 	"github.com/jmoiron/sqlx"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
@@ -20,6 +22,11 @@ import (
 var db *sqlx.DB
 
 func main() {
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1], os.Args[2:])
+		return
+	}
+
 	tp, _ := initTracer(context.Background())
 	defer func() {
 		if err := tp.Shutdown(context.Background()); err != nil {
@@ -28,6 +35,13 @@ func main() {
 	}()
 
 	mux := setup()
+	go startChairLocationCompaction()
+	go startScheduledRidePromotion()
+	go startZoneReload()
+	go startChairScheduler()
+	go startChairHeartbeatCheck()
+	go startRideAssignmentExpiry()
+	go startCacheInvalidationSubscriber()
 	slog.Info("Listening on :8080")
 	http.ListenAndServe(":8080", mux)
 }
@@ -73,7 +87,18 @@ func setup() http.Handler {
 		panic(err)
 	}
 	db = _db
+	rdb = GetRedisClient(context.Background())
+
+	// zones がまだ無い(初期化前の)DBでも起動はできるようにする
+	if err := loadZones(context.Background(), db); err != nil {
+		slog.Error("failed to load zones", slog.Any("error", err))
+	}
 
+	return newRouter()
+}
+
+// ルートを組み立てる。DBやRedisにはリクエストを処理するときまで触れない
+func newRouter() *chi.Mux {
 	mux := chi.NewRouter()
 	mux.Use(middleware.Logger)
 	mux.Use(middleware.Recoverer)
@@ -83,38 +108,102 @@ func setup() http.Handler {
 
 	mux.HandleFunc("POST /api/initialize", postInitialize)
 
+	// 頻度制限。登録は接続元IPごと、それ以外は認証した主体ごとに数える。
+	// 認証後の POST は Idempotency-Key で再送をまとめる
+	registrationLimit := newRateLimit("registration", 10, 100)
+	appLimit := newRateLimit("app", 20, 100)
+	ownerLimit := newRateLimit("owner", 20, 100)
+	chairLimit := newRateLimit("chair", 20, 100)
+	chairCoordinateLimit := newRateLimit("chair_coordinate", 5, 20)
+	adminLimit := newRateLimit("admin", 10, 50)
+	registrationMux := mux.With(registrationLimit.middleware)
+
 	// app handlers
 	{
-		mux.HandleFunc("POST /api/app/users", appPostUsers)
-
-		authedMux := mux.With(appAuthMiddleware)
+		registrationMux.HandleFunc("POST /api/app/users", appPostUsers)
+
+		authedMux := mux.With(appAuthMiddleware, appLimit.middleware, idempotencyMiddleware)
+		authedMux.HandleFunc("POST /api/app/logout", appPostLogout)
+		authedMux.HandleFunc("GET /api/app/me", appGetMe)
+		authedMux.HandleFunc("PATCH /api/app/me", appPatchMe)
+		authedMux.HandleFunc("DELETE /api/app/me", appDeleteMe)
+		authedMux.HandleFunc("GET /api/app/me/export", appGetMeExport)
 		authedMux.HandleFunc("POST /api/app/payment-methods", appPostPaymentMethods)
 		authedMux.HandleFunc("GET /api/app/rides", appGetRides)
 		authedMux.HandleFunc("POST /api/app/rides", appPostRides)
 		authedMux.HandleFunc("POST /api/app/rides/estimated-fare", appPostRidesEstimatedFare)
 		authedMux.HandleFunc("POST /api/app/rides/{ride_id}/evaluation", appPostRideEvaluatation)
+		authedMux.HandleFunc("GET /api/app/rides/{ride_id}/route", appGetRideRoute)
 		authedMux.HandleFunc("GET /api/app/notification", appGetNotification)
 		authedMux.HandleFunc("GET /api/app/nearby-chairs", appGetNearbyChairs)
+		authedMux.HandleFunc("GET /api/app/bookings", appGetBookings)
+		authedMux.HandleFunc("DELETE /api/app/bookings/{ride_id}", appDeleteBooking)
 	}
 
 	// owner handlers
 	{
-		mux.HandleFunc("POST /api/owner/owners", ownerPostOwners)
+		registrationMux.HandleFunc("POST /api/owner/owners", ownerPostOwners)
 
-		authedMux := mux.With(ownerAuthMiddleware)
+		authedMux := mux.With(ownerAuthMiddleware, ownerLimit.middleware, idempotencyMiddleware)
+		authedMux.HandleFunc("POST /api/owner/logout", ownerPostLogout)
 		authedMux.HandleFunc("GET /api/owner/sales", ownerGetSales)
 		authedMux.HandleFunc("GET /api/owner/chairs", ownerGetChairs)
+		authedMux.HandleFunc("GET /api/owner/chairs/stale", ownerGetStaleChairs)
+		authedMux.HandleFunc("GET /api/owner/chairs/{chair_id}/trail", ownerGetChairTrail)
+		authedMux.HandleFunc("GET /api/owner/chairs/{chair_id}/evaluations", ownerGetChairEvaluations)
+		authedMux.HandleFunc("POST /api/owner/chairs/{chair_id}/evaluations/{ride_id}/flag", ownerPostEvaluationFlag)
+		authedMux.HandleFunc("GET /api/owner/chairs/{chair_id}/api-keys", ownerGetChairAPIKeys)
+		authedMux.HandleFunc("POST /api/owner/chairs/{chair_id}/api-keys", ownerPostChairAPIKey)
+		authedMux.HandleFunc("DELETE /api/owner/chairs/{chair_id}/api-keys/{key_id}", ownerDeleteChairAPIKey)
 	}
 
 	// chair handlers
 	{
-		mux.HandleFunc("POST /api/chair/chairs", chairPostChairs)
+		registrationMux.HandleFunc("POST /api/chair/chairs", chairPostChairs)
+
+		authedMux := mux.With(chairAuthMiddleware, chairLimit.middleware, idempotencyMiddleware)
+		authedMux.HandleFunc("POST /api/chair/logout", chairPostLogout)
 
-		authedMux := mux.With(chairAuthMiddleware)
-		authedMux.HandleFunc("POST /api/chair/activity", chairPostActivity)
-		authedMux.HandleFunc("POST /api/chair/coordinate", chairPostCoordinate)
-		authedMux.HandleFunc("GET /api/chair/notification", chairGetNotification)
-		authedMux.HandleFunc("POST /api/chair/rides/{ride_id}/status", chairPostRideStatus)
+		activityMux := authedMux.With(requireChairScope(chairScopeActivity))
+		activityMux.HandleFunc("POST /api/chair/activity", chairPostActivity)
+		activityMux.HandleFunc("GET /api/chair/schedules", chairGetSchedules)
+		activityMux.HandleFunc("PUT /api/chair/schedules", chairPutSchedules)
+
+		locationMux := authedMux.With(requireChairScope(chairScopeLocation), chairCoordinateLimit.middleware)
+		locationMux.HandleFunc("POST /api/chair/coordinate", chairPostCoordinate)
+
+		ridesMux := authedMux.With(requireChairScope(chairScopeRides))
+		ridesMux.HandleFunc("GET /api/chair/notification", chairGetNotification)
+		ridesMux.HandleFunc("POST /api/chair/rides/{ride_id}/status", chairPostRideStatus)
+		ridesMux.HandleFunc("POST /api/chair/rides/{ride_id}/evaluation", chairPostRideEvaluation)
+	}
+
+	// admin handlers
+	{
+		authedMux := mux.With(adminAuthMiddleware, adminLimit.middleware, idempotencyMiddleware)
+
+		viewerMux := authedMux.With(requireAdminRole(adminRoleViewer))
+		viewerMux.HandleFunc("GET /api/admin/zones", adminGetZones)
+		viewerMux.HandleFunc("GET /api/admin/caches", adminGetCaches)
+		viewerMux.HandleFunc("GET /api/admin/users/{user_id}", adminGetUser)
+		viewerMux.HandleFunc("GET /api/admin/owners/{owner_id}", adminGetOwner)
+		viewerMux.HandleFunc("GET /api/admin/chairs/{chair_id}", adminGetChair)
+		viewerMux.HandleFunc("GET /api/admin/rides/{ride_id}", adminGetRide)
+		viewerMux.HandleFunc("GET /api/admin/matching", adminGetMatching)
+		viewerMux.HandleFunc("GET /api/admin/audit-logs", adminGetAuditLogs)
+
+		operatorMux := authedMux.With(requireAdminRole(adminRoleOperator))
+		operatorMux.HandleFunc("POST /api/admin/zones", adminPostZones)
+		operatorMux.HandleFunc("PUT /api/admin/zones/{zone_id}", adminPutZone)
+		operatorMux.HandleFunc("DELETE /api/admin/zones/{zone_id}", adminDeleteZone)
+		operatorMux.HandleFunc("POST /api/admin/rides/{ride_id}/complete", adminPostRideComplete)
+		operatorMux.HandleFunc("POST /api/admin/rides/{ride_id}/cancel", adminPostRideCancel)
+		operatorMux.HandleFunc("POST /api/admin/users/{user_id}/coupons", adminPostUserCoupon)
+
+		superuserMux := authedMux.With(requireAdminRole(adminRoleSuperuser))
+		superuserMux.HandleFunc("GET /api/admin/admins", adminGetAdmins)
+		superuserMux.HandleFunc("POST /api/admin/admins", adminPostAdmins)
+		superuserMux.HandleFunc("DELETE /api/admin/admins/{admin_id}", adminDeleteAdmin)
 	}
 
 	// internal handlers
@@ -126,7 +215,7 @@ func setup() http.Handler {
 }
 
 type postInitializeRequest struct {
-	PaymentServer string `json:"payment_server"`
+	PaymentServer string `json:"payment_server" validate:"required"`
 }
 
 type postInitializeResponse struct {
@@ -156,6 +245,9 @@ func postInitialize(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// sessions と chair_api_keys は作り直されているので古いキャッシュを捨てる
+	invalidateCache(ctx, cacheInvalidation{Kind: cacheInvalidationAll})
+
 	if err := initializeChairsTotalDistance(ctx); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
@@ -166,49 +258,22 @@ func postInitialize(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	writeJSON(w, http.StatusOK, postInitializeResponse{Language: "go"})
-}
-
-func initializeChairsTotalDistance(ctx context.Context) error {
-	type chairsWithTotalDistance struct {
-		ID                     string        `db:"id"`
-		OwnerID                string        `db:"owner_id"`
-		TotalDistance          sql.NullInt64 `db:"total_distance"`
-		TotalDistanceUpdatedAt sql.NullTime  `db:"total_distance_updated_at"`
+	if err := loadZones(ctx, db); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
 	}
-	var chairs []chairsWithTotalDistance
-	if err := db.SelectContext(ctx, &chairs, `
-SELECT id,
-  owner_id,
-  total_distance,
-  total_distance_updated_at
-FROM isu1.chairs
-  LEFT JOIN (SELECT chair_id,
-    SUM(COALESCE(distance, 0)) AS total_distance,
-    MAX(created_at)          AS total_distance_updated_at
-  FROM (SELECT chair_id,
-    created_at,
-    ABS(latitude - LAG(latitude) OVER (PARTITION BY chair_id ORDER BY created_at)) +
-    ABS(longitude - LAG(longitude) OVER (PARTITION BY chair_id ORDER BY created_at)) AS distance
-    FROM isu1.chair_locations) tmp
-  GROUP BY chair_id) distance_table ON distance_table.chair_id = chairs.id
-`); err != nil {
-		return fmt.Errorf("failed to select chairs: %w", err)
+
+	if err := initializeChairHeartbeats(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
 	}
-	for _, chair := range chairs {
-		var updatedAt int64
-		if chair.TotalDistanceUpdatedAt.Valid {
-			updatedAt = chair.TotalDistanceUpdatedAt.Time.UnixMilli()
-		}
-		var totalDistance int
-		if chair.TotalDistance.Valid {
-			totalDistance = int(chair.TotalDistance.Int64)
-		}
-		if err := addChairTotalDistance(ctx, chair.ID, totalDistance, updatedAt); err != nil {
-			return fmt.Errorf("failed to add chair total distance: %w", err)
-		}
+
+	if err := initializeChairsOfferCounts(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
 	}
-	return nil
+
+	writeJSON(w, http.StatusOK, postInitializeResponse{Language: "go"})
 }
 
 func initializeChairsTotalRideCount(ctx context.Context) error {
@@ -236,13 +301,18 @@ GROUP BY chair_id
 	return nil
 }
 
+// 座標は -1000 から 1000 まで
 type Coordinate struct {
-	Latitude  int `json:"latitude"`
-	Longitude int `json:"longitude"`
+	Latitude  int `json:"latitude" validate:"min=-1000,max=1000"`
+	Longitude int `json:"longitude" validate:"min=-1000,max=1000"`
 }
 
+// デコードしたあと validate タグで検証する
 func bindJSON(r *http.Request, v interface{}) error {
-	return json.NewDecoder(r.Body).Decode(v)
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return withErrorCode(errCodeInvalidJSON, err)
+	}
+	return validate.Struct(v)
 }
 
 func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
@@ -257,10 +327,14 @@ func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
 }
 
 func writeError(w http.ResponseWriter, statusCode int, err error) {
+	// 検証タグの誤りは入力ではなくサーバーの不具合
+	if errors.Is(err, validate.ErrInvalidTag) {
+		statusCode = http.StatusInternalServerError
+	}
 	_, filename, linenum, ok := runtime.Caller(1)
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
 	w.WriteHeader(statusCode)
-	buf, marshalError := json.Marshal(map[string]string{"message": err.Error()})
+	buf, marshalError := json.Marshal(newErrorResponse(statusCode, err))
 	if marshalError != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(`{"error":"marshaling error failed"}`))
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/isucon/isucon14/webapp/go/auth"
+	"github.com/samber/lo"
+)
+
+// 認証なしで呼べるルート
+var publicRoutes = []string{
+	"POST /api/initialize",
+	"POST /api/app/users",
+	"POST /api/owner/owners",
+	"POST /api/chair/chairs",
+	"GET /api/internal/matching",
+}
+
+var routeParamPattern = regexp.MustCompile(`\{[^}]+\}`)
+
+// 認証が要るルートに認証ミドルウェアを付け忘れていないか、認証情報なしで呼んで確かめる。
+// ハンドラーもコンテキストに主体が無ければ 401 を返すので、ミドルウェアが返した 401 かどうかまで見る
+func TestAuthedRoutesRequireCredentials(t *testing.T) {
+	mux := newRouter()
+	routes := 0
+	if err := chi.Walk(mux, func(method, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		routes++
+		if lo.Contains(publicRoutes, method+" "+route) {
+			return nil
+		}
+		t.Run(method+" "+route, func(t *testing.T) {
+			req := httptest.NewRequest(method, routeParamPattern.ReplaceAllString(route, "test"), nil)
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			if rec.Code != http.StatusUnauthorized {
+				t.Fatalf("status = %d, want %d", rec.Code, http.StatusUnauthorized)
+			}
+			res := &errorResponse{}
+			if err := json.Unmarshal(rec.Body.Bytes(), res); err != nil {
+				t.Fatal(err)
+			}
+			if strings.HasPrefix(res.Message, auth.ErrUnauthenticated.Error()) {
+				t.Errorf("rejected by the handler, not by an auth middleware: %s", res.Message)
+			}
+		})
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if routes == 0 {
+		t.Fatal("no routes")
+	}
+}
+
+// APIキーでログアウトしても失効しないので、成功したように見せず 400 を返す
+func TestChairAPIKeyCannotLogOut(t *testing.T) {
+	key := chairAPIKeyPrefix + "test"
+	keyHash := hashSessionToken(key)
+	chairAPIKeyCache.Set(keyHash, &cachedChairAPIKey{
+		apiKey: &ChairAPIKey{ID: "test", ChairID: "test", KeyHash: keyHash, Scopes: chairScopeRides},
+		chair:  &Chair{ID: "test"},
+	})
+	t.Cleanup(func() { chairAPIKeyCache.Del(keyHash) })
+
+	req := httptest.NewRequest(http.MethodPost, "/api/chair/logout", nil)
+	req.Header.Set("Authorization", "Bearer "+key)
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
@@ -2,202 +2,130 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"database/sql"
 	"errors"
 	"fmt"
 	"net/http"
-)
-
-func appAuthMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx := r.Context()
-		_, span := tracer.Start(ctx, "appAuthMiddleware")
-		defer span.End()
-
-		c, err := r.Cookie("app_session")
-		if errors.Is(err, http.ErrNoCookie) || c.Value == "" {
-			writeError(w, http.StatusUnauthorized, errors.New("app_session cookie is required"))
-			return
-		}
-		accessToken := c.Value
-		fmt.Printf("accessToken: %v\n", accessToken)
-		// user := &User{}
-		// err = db.GetContext(ctx, user, "SELECT * FROM users WHERE access_token = ?", accessToken)
-		// if err != nil {
-		// 	if errors.Is(err, sql.ErrNoRows) {
-		// 		writeError(w, http.StatusUnauthorized, errors.New("invalid access token"))
-		// 		return
-		// 	}
-		// 	writeError(w, http.StatusInternalServerError, err)
-		// 	return
-		// }
-		user, err := getCacheUser(ctx, accessToken)
+	"strings"
 
-		if err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				writeError(w, http.StatusUnauthorized, errors.New("invalid access token"))
-				return
-			}
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-		ctx = context.WithValue(ctx, "user", user)
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
-}
+	"github.com/isucon/isucon14/webapp/go/auth"
+)
 
-var userCache = NewCache[string, *User]()
+var (
+	appAuthMiddleware   = sessionAuthMiddleware[User](sessionRoleApp, "SELECT * FROM users WHERE id = ? AND deleted_at IS NULL")
+	ownerAuthMiddleware = sessionAuthMiddleware[Owner](sessionRoleOwner, "SELECT * FROM owners WHERE id = ?")
+)
 
-// userをシングルフライトでキャッシュする
-func getCacheUser(ctx context.Context, accessToken string) (*User, error) {
-	_, span := tracer.Start(ctx, "getCacheUser")
-	defer span.End()
-	user := &User{}
-	cacheUser, _ := userCache.Get(accessToken)
+const chairSubjectQuery = "SELECT * FROM isu1.chairs WHERE id = ?"
 
-	if cacheUser != nil {
-		// fmt.Println("cache hit %v", cacheUser)
-		return cacheUser, nil
-	}
+var chairSessionAuthMiddleware = sessionAuthMiddleware[Chair](sessionRoleChair, chairSubjectQuery)
 
-	err := db.GetContext(ctx, user, "SELECT * FROM users WHERE access_token = ?", accessToken)
-	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, errors.New("invalid access token")
+// 椅子はセッションの他に、Authorization: Bearer で送られたAPIキーでも認証する。
+// APIキーで認証した場合はキーもコンテキストに入れ、requireChairScope でスコープを確かめる
+func chairAuthMiddleware(next http.Handler) http.Handler {
+	sessionAuth := chairSessionAuthMiddleware(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := sessionToken(r, sessionRoleChair)
+		if !ok || !strings.HasPrefix(token, chairAPIKeyPrefix) {
+			sessionAuth.ServeHTTP(w, r)
+			return
 		}
-		return nil, err
-	}
-	// fmt.Println("cache nohit %v+", user)
-	userCache.Set(accessToken, user)
-
-	return user, nil
-}
 
-func ownerAuthMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
-		_, span := tracer.Start(ctx, "ownerAuthMiddleware")
+		_, span := tracer.Start(ctx, "chairAuthMiddleware")
 		defer span.End()
 
-		c, err := r.Cookie("owner_session")
-		if errors.Is(err, http.ErrNoCookie) || c.Value == "" {
-			writeError(w, http.StatusUnauthorized, errors.New("owner_session cookie is required"))
-			return
-		}
-		accessToken := c.Value
-		// owner := &Owner{}
-		// if err := db.GetContext(ctx, owner, "SELECT * FROM owners WHERE access_token = ?", accessToken); err != nil {
-		// 	if errors.Is(err, sql.ErrNoRows) {
-		// 		writeError(w, http.StatusUnauthorized, errors.New("invalid access token"))
-		// 		return
-		// 	}
-		// 	writeError(w, http.StatusInternalServerError, err)
-		// 	return
-		// }
-
-		owner, err := getCacheOwner(ctx, accessToken)
+		chair, apiKey, err := getChairByAPIKey(ctx, token)
 		if err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
-				writeError(w, http.StatusUnauthorized, errors.New("invalid access token"))
+				writeError(w, http.StatusUnauthorized, errors.New("invalid or revoked api key"))
 				return
 			}
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
-
-		ctx = context.WithValue(ctx, "owner", owner)
+		ctx = auth.With(ctx, chair)
+		ctx = auth.With(ctx, apiKey)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
-var ownerCache = NewCache[string, *Owner]()
-
-// ownerをキャッシュする
-func getCacheOwner(ctx context.Context, accessToken string) (*Owner, error) {
-	_, span := tracer.Start(ctx, "getCacheUser")
-	defer span.End()
-	cacheOwner, _ := ownerCache.Get(accessToken)
-
-	if cacheOwner != nil {
-		// fmt.Println("cache hit %v", cacheOwner)
-		return cacheOwner, nil
-	}
-
-	owner := &Owner{}
-	err := db.GetContext(ctx, owner, "SELECT * FROM owners WHERE access_token = ?", accessToken)
-	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, errors.New("invalid access token")
-		}
-		return nil, err
+// セッションで認証した椅子は全てのAPIを使える
+func requireChairScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if apiKey, err := auth.From[ChairAPIKey](r.Context()); err == nil && !apiKey.hasScope(scope) {
+				writeError(w, http.StatusForbidden, fmt.Errorf("api key does not have %s scope", scope))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
 	}
-	// fmt.Println("cache nohit %v+", owner)
-	ownerCache.Set(accessToken, owner)
-
-	return owner, nil
 }
 
-func chairAuthMiddleware(next http.Handler) http.Handler {
+// 管理APIは Authorization: Bearer で管理者のトークンか ADMIN_TOKEN を送って認証する
+var adminToken = GetEnv("ADMIN_TOKEN", "")
+
+func adminAuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
-		_, span := tracer.Start(ctx, "chairAuthMiddleware")
+		_, span := tracer.Start(ctx, "adminAuthMiddleware")
 		defer span.End()
 
-		c, err := r.Cookie("chair_session")
-		if errors.Is(err, http.ErrNoCookie) || c.Value == "" {
-			writeError(w, http.StatusUnauthorized, errors.New("chair_session cookie is required"))
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			writeError(w, http.StatusUnauthorized, errors.New("admin token is required"))
 			return
 		}
-		accessToken := c.Value
-		// chair := &Chair{}
-		// err = db.GetContext(ctx, chair, "SELECT * FROM chairs WHERE access_token = ?", accessToken)
-		// if err != nil {
-		// 	if errors.Is(err, sql.ErrNoRows) {
-		// 		writeError(w, http.StatusUnauthorized, errors.New("invalid access token"))
-		// 		return
-		// 	}
-		// 	writeError(w, http.StatusInternalServerError, err)
-		// 	return
-		// }
-		chair, err := getCacheChair(ctx, accessToken)
-
-		if err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				writeError(w, http.StatusUnauthorized, errors.New("invalid access token"))
+		var admin *Admin
+		if adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1 {
+			admin = bootstrapAdmin
+		} else {
+			a, err := getAdminByToken(ctx, token)
+			if err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					writeError(w, http.StatusUnauthorized, errors.New("invalid admin token"))
+					return
+				}
+				writeError(w, http.StatusInternalServerError, err)
 				return
 			}
-			writeError(w, http.StatusInternalServerError, err)
-			return
+			admin = a
 		}
-
-		ctx = context.WithValue(ctx, "chair", chair)
-		next.ServeHTTP(w, r.WithContext(ctx))
+		next.ServeHTTP(w, r.WithContext(auth.With(ctx, admin)))
 	})
 }
 
-var chairCache = NewCache[string, *Chair]()
+func requireAdminRole(role string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			admin, err := AdminFrom(r.Context())
+			if err != nil {
+				writeError(w, http.StatusUnauthorized, err)
+				return
+			}
+			if !admin.hasRole(role) {
+				writeError(w, http.StatusForbidden, fmt.Errorf("%s role is required", role))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
 
-// chairをキャッシュする
-func getCacheChair(ctx context.Context, accessToken string) (*Chair, error) {
-	_, span := tracer.Start(ctx, "getCacheUser")
-	defer span.End()
-	cacheChair, _ := chairCache.Get(accessToken)
+func UserFrom(ctx context.Context) (*User, error) {
+	return auth.From[User](ctx)
+}
 
-	if cacheChair != nil {
-		// fmt.Println("cache hit %v", cacheChair)
-		return cacheChair, nil
-	}
+func OwnerFrom(ctx context.Context) (*Owner, error) {
+	return auth.From[Owner](ctx)
+}
 
-	chair := &Chair{}
-	err := db.GetContext(ctx, chair, "SELECT * FROM isu1.chairs WHERE access_token = ?", accessToken)
-	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, errors.New("invalid access token")
-		}
-		return nil, err
-	}
-	// fmt.Println("cache nohit %v+", chair)
-	chairCache.Set(accessToken, chair)
+func ChairFrom(ctx context.Context) (*Chair, error) {
+	return auth.From[Chair](ctx)
+}
 
-	return chair, nil
+func AdminFrom(ctx context.Context) (*Admin, error) {
+	return auth.From[Admin](ctx)
 }
@@ -6,14 +6,14 @@ import (
 )
 
 type Chair struct {
-	ID          string    `db:"id"`
-	OwnerID     string    `db:"owner_id"`
-	Name        string    `db:"name"`
-	Model       string    `db:"model"`
-	IsActive    bool      `db:"is_active"`
-	AccessToken string    `db:"access_token"`
-	CreatedAt   time.Time `db:"created_at"`
-	UpdatedAt   time.Time `db:"updated_at"`
+	ID          string         `db:"id"`
+	OwnerID     string         `db:"owner_id"`
+	Name        string         `db:"name"`
+	Model       string         `db:"model"`
+	IsActive    bool           `db:"is_active"`
+	AccessToken sql.NullString `db:"access_token"`
+	CreatedAt   time.Time      `db:"created_at"`
+	UpdatedAt   time.Time      `db:"updated_at"`
 }
 
 type ChairModel struct {
@@ -30,15 +30,16 @@ type ChairLocation struct {
 }
 
 type User struct {
-	ID             string    `db:"id"`
-	Username       string    `db:"username"`
-	Firstname      string    `db:"firstname"`
-	Lastname       string    `db:"lastname"`
-	DateOfBirth    string    `db:"date_of_birth"`
-	AccessToken    string    `db:"access_token"`
-	InvitationCode string    `db:"invitation_code"`
-	CreatedAt      time.Time `db:"created_at"`
-	UpdatedAt      time.Time `db:"updated_at"`
+	ID             string         `db:"id"`
+	Username       string         `db:"username"`
+	Firstname      string         `db:"firstname"`
+	Lastname       string         `db:"lastname"`
+	DateOfBirth    string         `db:"date_of_birth"`
+	AccessToken    sql.NullString `db:"access_token"`
+	InvitationCode string         `db:"invitation_code"`
+	CreatedAt      time.Time      `db:"created_at"`
+	UpdatedAt      time.Time      `db:"updated_at"`
+	DeletedAt      sql.NullTime   `db:"deleted_at"`
 }
 
 type PaymentToken struct {
@@ -58,6 +59,13 @@ type Ride struct {
 	Evaluation           *int           `db:"evaluation"`
 	CreatedAt            time.Time      `db:"created_at"`
 	UpdatedAt            time.Time      `db:"updated_at"`
+	Status               string         `db:"status"`
+	PickupAt             sql.NullTime   `db:"pickup_at"`
+	Pooled               bool           `db:"pooled"`
+	PooledWith           sql.NullString `db:"pooled_with"`
+	PoolDiscount         int            `db:"pool_discount"`
+	FareRatePercent      int            `db:"fare_rate_percent"`
+	UserEvaluation       *int           `db:"user_evaluation"`
 }
 
 type RideStatus struct {
@@ -70,12 +78,12 @@ type RideStatus struct {
 }
 
 type Owner struct {
-	ID                 string    `db:"id"`
-	Name               string    `db:"name"`
-	AccessToken        string    `db:"access_token"`
-	ChairRegisterToken string    `db:"chair_register_token"`
-	CreatedAt          time.Time `db:"created_at"`
-	UpdatedAt          time.Time `db:"updated_at"`
+	ID                 string         `db:"id"`
+	Name               string         `db:"name"`
+	AccessToken        sql.NullString `db:"access_token"`
+	ChairRegisterToken string         `db:"chair_register_token"`
+	CreatedAt          time.Time      `db:"created_at"`
+	UpdatedAt          time.Time      `db:"updated_at"`
 }
 
 type Coupon struct {
@@ -85,3 +93,91 @@ type Coupon struct {
 	CreatedAt time.Time `db:"created_at"`
 	UsedBy    *string   `db:"used_by"`
 }
+
+type RideWaypoint struct {
+	RideID    string     `db:"ride_id"`
+	Position  int        `db:"position"`
+	Latitude  int        `db:"latitude"`
+	Longitude int        `db:"longitude"`
+	Status    string     `db:"status"`
+	ReachedAt *time.Time `db:"reached_at"`
+}
+
+type Zone struct {
+	ID              string    `db:"id"`
+	Name            string    `db:"name"`
+	Polygon         string    `db:"polygon"`
+	FareRatePercent int       `db:"fare_rate_percent"`
+	CreatedAt       time.Time `db:"created_at"`
+	UpdatedAt       time.Time `db:"updated_at"`
+}
+
+type ZoneAdjacency struct {
+	ZoneID         string `db:"zone_id"`
+	AdjacentZoneID string `db:"adjacent_zone_id"`
+}
+
+type ChairSchedule struct {
+	ChairID     string `db:"chair_id"`
+	Weekday     int    `db:"weekday"`
+	StartMinute int    `db:"start_minute"`
+	EndMinute   int    `db:"end_minute"`
+}
+
+type ChairScheduleState struct {
+	ChairID   string       `db:"chair_id"`
+	InShift   sql.NullBool `db:"in_shift"`
+	UpdatedAt time.Time    `db:"updated_at"`
+}
+
+type RideAssignment struct {
+	ID         string     `db:"id"`
+	RideID     string     `db:"ride_id"`
+	ChairID    string     `db:"chair_id"`
+	Status     string     `db:"status"`
+	AssignedAt time.Time  `db:"assigned_at"`
+	DeadlineAt time.Time  `db:"deadline_at"`
+	ResolvedAt *time.Time `db:"resolved_at"`
+}
+
+type Session struct {
+	TokenHash  string       `db:"token_hash"`
+	Role       string       `db:"role"`
+	SubjectID  string       `db:"subject_id"`
+	CreatedAt  time.Time    `db:"created_at"`
+	LastUsedAt time.Time    `db:"last_used_at"`
+	ExpiresAt  time.Time    `db:"expires_at"`
+	RevokedAt  sql.NullTime `db:"revoked_at"`
+}
+
+type ChairAPIKey struct {
+	ID         string       `db:"id"`
+	ChairID    string       `db:"chair_id"`
+	Name       string       `db:"name"`
+	KeyHash    string       `db:"key_hash"`
+	KeyPrefix  string       `db:"key_prefix"`
+	Scopes     string       `db:"scopes"`
+	CreatedAt  time.Time    `db:"created_at"`
+	LastUsedAt sql.NullTime `db:"last_used_at"`
+	RevokedAt  sql.NullTime `db:"revoked_at"`
+}
+
+type Admin struct {
+	ID        string       `db:"id"`
+	Name      string       `db:"name"`
+	Role      string       `db:"role"`
+	TokenHash string       `db:"token_hash"`
+	CreatedAt time.Time    `db:"created_at"`
+	RevokedAt sql.NullTime `db:"revoked_at"`
+}
+
+type AdminAuditLog struct {
+	ID         string    `db:"id"`
+	AdminID    string    `db:"admin_id"`
+	AdminName  string    `db:"admin_name"`
+	Action     string    `db:"action"`
+	TargetType string    `db:"target_type"`
+	TargetID   string    `db:"target_id"`
+	Detail     string    `db:"detail"`
+	CreatedAt  time.Time `db:"created_at"`
+}
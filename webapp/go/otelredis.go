@@ -10,7 +10,8 @@ import (
 	"github.com/redis/go-redis/v9"
 )
 
-var rdb = GetRedisClient(context.Background())
+// 起動時に setup か runCommand で繋ぐ
+var rdb *redis.Client
 
 func GetRedisClient(ctx context.Context) *redis.Client {
 	_, span := // redis.confで外部接続許可を忘れずに
@@ -14,13 +14,8 @@ import (
 	"github.com/samber/lo"
 )
 
-const (
-	initialFare     = 500
-	farePerDistance = 100
-)
-
 type ownerPostOwnersRequest struct {
-	Name string `json:"name"`
+	Name string `json:"name" validate:"required,max=30"`
 }
 
 type ownerPostOwnersResponse struct {
@@ -38,30 +33,39 @@ func ownerPostOwners(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, err)
 		return
 	}
-	if req.Name == "" {
-		writeError(w, http.StatusBadRequest, errors.New("some of required fields(name) are empty"))
-		return
-	}
 
 	ownerID := ulid.Make().String()
-	accessToken := secureRandomStr(32)
 	chairRegisterToken := secureRandomStr(32)
 
-	_, err := db.ExecContext(
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	token, err := createSession(ctx, tx, sessionRoleOwner, ownerID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	_, err = tx.ExecContext(
 		ctx,
-		"INSERT INTO owners (id, name, access_token, chair_register_token) VALUES (?, ?, ?, ?)",
-		ownerID, req.Name, accessToken, chairRegisterToken,
+		"INSERT INTO owners (id, name, chair_register_token) VALUES (?, ?, ?)",
+		ownerID, req.Name, chairRegisterToken,
 	)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Path:  "/",
-		Name:  "owner_session",
-		Value: accessToken,
-	})
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	setSessionCookie(w, sessionRoleOwner, token)
 
 	writeJSON(w, http.StatusCreated, &ownerPostOwnersResponse{
 		ID:                 ownerID,
@@ -69,6 +73,14 @@ func ownerPostOwners(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+func ownerPostLogout(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	_, span := tracer.Start(ctx, "ownerPostLogout")
+	defer span.End()
+
+	logout(w, r, sessionRoleOwner)
+}
+
 type chairSales struct {
 	ID    string `json:"id"`
 	Name  string `json:"name"`
@@ -110,7 +122,11 @@ func ownerGetSales(w http.ResponseWriter, r *http.Request) {
 		until = time.UnixMilli(parsed)
 	}
 
-	owner := r.Context().Value("owner").(*Owner)
+	owner, err := OwnerFrom(r.Context())
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
 
 	tx, err := db.Beginx()
 	if err != nil {
@@ -133,12 +149,18 @@ func ownerGetSales(w http.ResponseWriter, r *http.Request) {
 	for _, chair := range chairs {
 		rides := []Ride{}
 
-		if err := tx.SelectContext(ctx, &rides, "SELECT rides.* FROM rides JOIN ride_statuses ON rides.id = ride_statuses.ride_id WHERE chair_id = ? AND status = 'COMPLETED' AND updated_at BETWEEN ? AND ?", chair.ID, since, until.Add(999*time.Microsecond)); err != nil {
+		if err := tx.SelectContext(ctx, &rides, "SELECT * FROM rides WHERE chair_id = ? AND status = 'COMPLETED' AND updated_at BETWEEN ? AND ?", chair.ID, since, until.Add(999*time.Microsecond)); err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
 
-		sales := sumSales(rides)
+		waypoints, err := getRidesWaypoints(ctx, tx, lo.Map(rides, func(ride Ride, _ int) string { return ride.ID }))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		sales := sumSales(rides, waypoints)
 		res.TotalSales += sales
 
 		res.Chairs = append(res.Chairs, chairSales{
@@ -162,23 +184,22 @@ func ownerGetSales(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, res)
 }
 
-func sumSales(rides []Ride) int {
+func sumSales(rides []Ride, waypoints map[string][]Coordinate) int {
 	sale := 0
 	for _, ride := range rides {
-		sale += calculateSale(ride)
+		sale += calculateSale(ride, waypoints[ride.ID])
 	}
 	return sale
 }
 
-func calculateSale(ride Ride) int {
-	return calculateFare(ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+func calculateSale(ride Ride, waypoints []Coordinate) int {
+	return calculateRideFare(&ride, 0, waypoints)
 }
 
 type chairWithDetail struct {
 	ID                     string       `db:"id"`
 	OwnerID                string       `db:"owner_id"`
 	Name                   string       `db:"name"`
-	AccessToken            string       `db:"access_token"`
 	Model                  string       `db:"model"`
 	IsActive               int          `db:"is_active"`
 	CreatedAt              time.Time    `db:"created_at"`
@@ -192,36 +213,15 @@ type ownerGetChairResponse struct {
 }
 
 type ownerGetChairResponseChair struct {
-	ID                     string `json:"id"`
-	Name                   string `json:"name"`
-	Model                  string `json:"model"`
-	Active                 bool   `json:"active"`
-	RegisteredAt           int64  `json:"registered_at"`
-	TotalDistance          int    `json:"total_distance"`
-	TotalDistanceUpdatedAt *int64 `json:"total_distance_updated_at,omitempty"`
-}
-
-func chairTotalDistanceKey(chairID string) string {
-	return fmt.Sprintf("chair:%s:total_distance", chairID)
-}
-
-func chairTotalDistanceUpdatedAtKey(chairID string) string {
-	return fmt.Sprintf("chair:%s:total_distance_updated_at", chairID)
-}
-
-func addChairTotalDistance(ctx context.Context, chairID string, distance int, updatedAtMilli int64) error {
-	if _, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
-		if err := pipe.IncrBy(ctx, chairTotalDistanceKey(chairID), int64(distance)).Err(); err != nil {
-			return fmt.Errorf("failed to add total distance: %w", err)
-		}
-		if err := pipe.Set(ctx, chairTotalDistanceUpdatedAtKey(chairID), updatedAtMilli, 0).Err(); err != nil {
-			return fmt.Errorf("failed to set total distance updated at: %w", err)
-		}
-		return nil
-	}); err != nil {
-		return fmt.Errorf("failed to add total distance: %w", err)
-	}
-	return nil
+	ID                     string  `json:"id"`
+	Name                   string  `json:"name"`
+	Model                  string  `json:"model"`
+	Active                 bool    `json:"active"`
+	RegisteredAt           int64   `json:"registered_at"`
+	TotalDistance          int     `json:"total_distance"`
+	TotalDistanceUpdatedAt *int64  `json:"total_distance_updated_at,omitempty"`
+	OfferCount             int     `json:"offer_count"`
+	AcceptanceRate         float64 `json:"acceptance_rate"`
 }
 
 func chairTotalRideCountKey(chairID string) string {
@@ -262,46 +262,6 @@ func setChairTotalRideCount(ctx context.Context, chairID string, totalRideCount
 	return nil
 }
 
-type chairTotalDistance struct {
-	ChairID       string
-	TotalDistance int
-	UpdatedAt     int64
-}
-
-func getChairsTotalDistances(ctx context.Context, chairIDs []string) (map[string]*chairTotalDistance, error) {
-	keys := lo.FlatMap(chairIDs, func(id string, _ int) []string {
-		return []string{
-			chairTotalDistanceKey(id),
-			chairTotalDistanceUpdatedAtKey(id),
-		}
-	})
-	result := rdb.MGet(ctx, keys...)
-	if err := result.Err(); err != nil {
-		return nil, fmt.Errorf("failed to get total distances: %w", err)
-	}
-	chairTotalDistances := make(map[string]*chairTotalDistance, len(chairIDs))
-	vals := result.Val()
-	for i := 0; i < len(keys); i += 2 {
-		if vals[i] == nil {
-			continue
-		}
-		distance, err := strconv.Atoi(vals[i].(string))
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse total distance: %w", err)
-		}
-		updatedAt, err := strconv.ParseInt(vals[i+1].(string), 10, 64)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse total distance updated at: %w", err)
-		}
-		chairTotalDistances[chairIDs[i/2]] = &chairTotalDistance{
-			ChairID:       chairIDs[i/2],
-			TotalDistance: distance,
-			UpdatedAt:     updatedAt,
-		}
-	}
-	return chairTotalDistances, nil
-}
-
 type chairTotalRideCount struct {
 	ChairID         string
 	TotalRideCount  int
@@ -354,7 +314,11 @@ func ownerGetChairs(w http.ResponseWriter, r *http.Request) {
 	_, span := tracer.Start(ctx, "ownerGetChairs")
 	defer span.End()
 
-	owner := ctx.Value("owner").(*Owner)
+	owner, err := OwnerFrom(ctx)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
 
 	type chairDetail struct {
 		ID        string    `db:"id"`
@@ -367,7 +331,7 @@ func ownerGetChairs(w http.ResponseWriter, r *http.Request) {
 	if err := db.SelectContext(
 		ctx,
 		&chairs,
-		`SELECT id, owner_id, name, access_token, model, is_active, created_at, updated_at FROM isu1.chairs WHERE owner_id = ?`,
+		`SELECT id, owner_id, name, model, is_active, created_at, updated_at FROM isu1.chairs WHERE owner_id = ?`,
 		owner.ID,
 	); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
@@ -379,6 +343,11 @@ func ownerGetChairs(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	offerCounts, err := getChairsOfferCounts(ctx, chaidIDs)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
 
 	res := ownerGetChairResponse{}
 	for _, chair := range chairs {
@@ -404,7 +373,388 @@ func ownerGetChairs(w http.ResponseWriter, r *http.Request) {
 			TotalDistance:          totalDistance,
 			TotalDistanceUpdatedAt: totalDistanceUpdatedAt,
 		}
+		if offerCount := offerCounts[chair.ID]; offerCount != nil {
+			c.OfferCount = offerCount.Offered
+			c.AcceptanceRate = offerCount.acceptanceRate()
+		}
 		res.Chairs = append(res.Chairs, c)
 	}
 	writeJSON(w, http.StatusOK, res)
 }
+
+func ownerGetChairTrail(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	_, span := tracer.Start(ctx, "ownerGetChairTrail")
+	defer span.End()
+
+	chairID := r.PathValue("chair_id")
+
+	since, err := parseUnixMilliQuery(r, "since", time.Unix(0, 0))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	until, err := parseUnixMilliQuery(r, "until", time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	owner, err := OwnerFrom(ctx)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	chair := &Chair{}
+	if err := db.GetContext(ctx, chair, "SELECT * FROM isu1.chairs WHERE id = ?", chairID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("chair not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if chair.OwnerID != owner.ID {
+		writeError(w, http.StatusNotFound, errors.New("chair not found"))
+		return
+	}
+
+	locations, err := selectChairTrail(ctx, db, chair.ID, since, until.Add(999*time.Microsecond))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeChairTrail(w, r, chair.ID, locations, nil)
+}
+
+type ownerGetStaleChairsResponse struct {
+	Chairs []ownerGetStaleChairsResponseChair `json:"chairs"`
+}
+
+type ownerGetStaleChairsResponseChair struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Model      string `json:"model"`
+	LastSeenAt int64  `json:"last_seen_at"`
+}
+
+// ハートビートが途絶えてマッチング対象から外れている椅子の一覧
+func ownerGetStaleChairs(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	_, span := tracer.Start(ctx, "ownerGetStaleChairs")
+	defer span.End()
+
+	owner, err := OwnerFrom(ctx)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	chairs := []Chair{}
+	if err := db.SelectContext(ctx, &chairs, `SELECT * FROM isu1.chairs WHERE owner_id = ? ORDER BY id`, owner.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	chairsByID := lo.KeyBy(chairs, func(chair Chair) string { return chair.ID })
+
+	stales, err := getStaleChairs(ctx, lo.Map(chairs, func(chair Chair, _ int) string { return chair.ID }))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := ownerGetStaleChairsResponse{Chairs: []ownerGetStaleChairsResponseChair{}}
+	for _, stale := range stales {
+		chair := chairsByID[stale.ChairID]
+		res.Chairs = append(res.Chairs, ownerGetStaleChairsResponseChair{
+			ID:         chair.ID,
+			Name:       chair.Name,
+			Model:      chair.Model,
+			LastSeenAt: stale.LastSeenAt,
+		})
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+type ownerGetChairEvaluationsResponse struct {
+	TagCounts   map[string]int                         `json:"tag_counts"`
+	Evaluations []ownerGetChairEvaluationsResponseItem `json:"evaluations"`
+}
+
+type ownerGetChairEvaluationsResponseItem struct {
+	RideID      string   `json:"ride_id"`
+	Evaluation  int      `json:"evaluation"`
+	Comment     *string  `json:"comment,omitempty"`
+	Tags        []string `json:"tags"`
+	EvaluatedAt int64    `json:"evaluated_at"`
+}
+
+// オーナーの椅子が受けた評価(コメント・タグ付き)とタグの集計
+func ownerGetChairEvaluations(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	_, span := tracer.Start(ctx, "ownerGetChairEvaluations")
+	defer span.End()
+
+	chairID := r.PathValue("chair_id")
+	owner, err := OwnerFrom(ctx)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed <= 0 || parsed > 100 {
+			writeError(w, http.StatusBadRequest, errors.New("limit must be between 1 and 100"))
+			return
+		}
+		limit = parsed
+	}
+
+	if _, err := getOwnerChair(ctx, owner, chairID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("chair not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	evaluations, err := selectChairEvaluations(ctx, db, chairID, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	tagCounts, err := selectChairEvaluationTagCounts(ctx, db, chairID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := ownerGetChairEvaluationsResponse{
+		TagCounts:   tagCounts,
+		Evaluations: make([]ownerGetChairEvaluationsResponseItem, 0, len(evaluations)),
+	}
+	for _, e := range evaluations {
+		res.Evaluations = append(res.Evaluations, ownerGetChairEvaluationsResponseItem{
+			RideID:      e.RideID,
+			Evaluation:  e.Evaluation,
+			Comment:     e.Comment,
+			Tags:        e.Tags,
+			EvaluatedAt: e.EvaluatedAt.UnixMilli(),
+		})
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+type ownerPostEvaluationFlagRequest struct {
+	Reason string `json:"reason" validate:"required,max=500"`
+}
+
+// 不適切なコメントを通報する。通報されたコメントは FLAGGED になり表示されなくなる
+func ownerPostEvaluationFlag(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	_, span := tracer.Start(ctx, "ownerPostEvaluationFlag")
+	defer span.End()
+
+	chairID := r.PathValue("chair_id")
+	rideID := r.PathValue("ride_id")
+	owner, err := OwnerFrom(ctx)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	req := &ownerPostEvaluationFlagRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if _, err := getOwnerChair(ctx, owner, chairID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("chair not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	result, err := db.ExecContext(
+		ctx,
+		`UPDATE evaluation_comments SET moderation_status = 'FLAGGED', flag_reason = ?, flagged_at = CURRENT_TIMESTAMP(6) WHERE ride_id = ? AND chair_id = ? AND moderation_status = 'VISIBLE'`,
+		req.Reason, rideID, chairID,
+	)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if n == 0 {
+		writeError(w, http.StatusNotFound, errors.New("comment not found"))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type ownerChairAPIKey struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	KeyPrefix  string   `json:"key_prefix"`
+	Scopes     []string `json:"scopes"`
+	CreatedAt  int64    `json:"created_at"`
+	LastUsedAt *int64   `json:"last_used_at,omitempty"`
+	RevokedAt  *int64   `json:"revoked_at,omitempty"`
+}
+
+func newOwnerChairAPIKey(k *ChairAPIKey) ownerChairAPIKey {
+	res := ownerChairAPIKey{
+		ID:        k.ID,
+		Name:      k.Name,
+		KeyPrefix: k.KeyPrefix,
+		Scopes:    k.scopes(),
+		CreatedAt: k.CreatedAt.UnixMilli(),
+	}
+	if k.LastUsedAt.Valid {
+		res.LastUsedAt = lo.ToPtr(k.LastUsedAt.Time.UnixMilli())
+	}
+	if k.RevokedAt.Valid {
+		res.RevokedAt = lo.ToPtr(k.RevokedAt.Time.UnixMilli())
+	}
+	return res
+}
+
+type ownerGetChairAPIKeysResponse struct {
+	APIKeys []ownerChairAPIKey `json:"api_keys"`
+}
+
+func ownerGetChairAPIKeys(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	_, span := tracer.Start(ctx, "ownerGetChairAPIKeys")
+	defer span.End()
+
+	chairID := r.PathValue("chair_id")
+	owner, err := OwnerFrom(ctx)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	if _, err := getOwnerChair(ctx, owner, chairID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("chair not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	apiKeys, err := selectChairAPIKeys(ctx, chairID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ownerGetChairAPIKeysResponse{
+		APIKeys: lo.Map(apiKeys, func(k ChairAPIKey, _ int) ownerChairAPIKey { return newOwnerChairAPIKey(&k) }),
+	})
+}
+
+type ownerPostChairAPIKeyRequest struct {
+	Name   string   `json:"name" validate:"required,max=50"`
+	Scopes []string `json:"scopes" validate:"required,dive,oneof=location rides activity"`
+}
+
+type ownerPostChairAPIKeyResponse struct {
+	ownerChairAPIKey
+	Key string `json:"key"`
+}
+
+// キーはこのレスポンスでしか返さない
+func ownerPostChairAPIKey(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	_, span := tracer.Start(ctx, "ownerPostChairAPIKey")
+	defer span.End()
+
+	chairID := r.PathValue("chair_id")
+	owner, err := OwnerFrom(ctx)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	req := &ownerPostChairAPIKeyRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if _, err := getOwnerChair(ctx, owner, chairID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("chair not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	apiKey, key, err := createChairAPIKey(ctx, chairID, req.Name, req.Scopes)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, ownerPostChairAPIKeyResponse{
+		ownerChairAPIKey: newOwnerChairAPIKey(apiKey),
+		Key:              key,
+	})
+}
+
+func ownerDeleteChairAPIKey(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	_, span := tracer.Start(ctx, "ownerDeleteChairAPIKey")
+	defer span.End()
+
+	chairID := r.PathValue("chair_id")
+	keyID := r.PathValue("key_id")
+	owner, err := OwnerFrom(ctx)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	if _, err := getOwnerChair(ctx, owner, chairID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("chair not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := revokeChairAPIKey(ctx, chairID, keyID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("api key not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// オーナーが所有する椅子を取得する。他のオーナーの椅子なら sql.ErrNoRows
+func getOwnerChair(ctx context.Context, owner *Owner, chairID string) (*Chair, error) {
+	chair := &Chair{}
+	if err := db.GetContext(ctx, chair, "SELECT * FROM isu1.chairs WHERE id = ? AND owner_id = ?", chairID, owner.ID); err != nil {
+		return nil, err
+	}
+	return chair, nil
+}
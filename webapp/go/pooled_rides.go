@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 相乗りを許可したライドは、同じく相乗りを許可したライドを CARRYING 中の椅子に追加で割り当てられる。
+// 先に乗っている乗客の遠回り(目的地までの距離の増分)が POOL_MAX_DETOUR_PERCENT 以内のときだけ相乗りにする
+var poolMaxDetourPercent = GetEnvInt("POOL_MAX_DETOUR_PERCENT", "30")
+
+type pooledRideCandidate struct {
+	Ride
+	ChairLatitude  int `db:"chair_latitude"`
+	ChairLongitude int `db:"chair_longitude"`
+	ChairSpeed     int `db:"chair_speed"`
+}
+
+// 相乗り先の椅子を探す。見つからなければnil。excludePremium なら上位モデルの椅子は選ばない
+func findPooledRideCandidate(ctx context.Context, tx *sqlx.Tx, ride *Ride, excludePremium bool) (*pooledRideCandidate, error) {
+	_, span := tracer.Start(ctx, "findPooledRideCandidate")
+	defer span.End()
+
+	candidates := []pooledRideCandidate{}
+	if err := tx.SelectContext(ctx, &candidates, `
+SELECT rides.*, loc.latitude AS chair_latitude, loc.longitude AS chair_longitude, COALESCE(chair_models.speed, 0) AS chair_speed
+FROM rides
+  LEFT JOIN isu1.chairs ON chairs.id = rides.chair_id
+  LEFT JOIN chair_models ON chair_models.name = chairs.model
+  JOIN LATERAL (SELECT latitude, longitude FROM isu1.chair_locations WHERE chair_id = rides.chair_id ORDER BY id DESC LIMIT 1) loc ON TRUE
+WHERE rides.pooled
+  AND rides.status = 'CARRYING'
+  AND rides.pooled_with IS NULL
+  AND NOT EXISTS (SELECT 1 FROM rides other
+    WHERE other.chair_id = rides.chair_id AND other.id <> rides.id AND other.status NOT IN ('COMPLETED', 'CANCELED'))
+  AND NOT EXISTS (SELECT 1 FROM ride_assignments
+    WHERE ride_assignments.ride_id = ? AND ride_assignments.chair_id = rides.chair_id AND ride_assignments.status IN ('REJECTED', 'EXPIRED'))
+FOR UPDATE OF rides SKIP LOCKED
+`, ride.ID); err != nil {
+		return nil, err
+	}
+
+	var best *pooledRideCandidate
+	bestDetour := 0
+	for i := range candidates {
+		c := &candidates[i]
+		if excludePremium && c.ChairSpeed >= premiumChairMinSpeed {
+			continue
+		}
+		if !zones.matchable(Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude}, Coordinate{Latitude: c.ChairLatitude, Longitude: c.ChairLongitude}) {
+			continue
+		}
+		detour, ok := pooledDetour(c, ride)
+		if !ok {
+			continue
+		}
+		if best == nil || detour < bestDetour {
+			best = c
+			bestDetour = detour
+		}
+	}
+	return best, nil
+}
+
+// 椅子の現在地 -> 新しい乗客の配車位置 -> 先の乗客の目的地 と回ったときの先の乗客の遠回り距離
+func pooledDetour(c *pooledRideCandidate, ride *Ride) (int, bool) {
+	direct := calculateDistance(c.ChairLatitude, c.ChairLongitude, c.DestinationLatitude, c.DestinationLongitude)
+	pooled := calculateDistance(c.ChairLatitude, c.ChairLongitude, ride.PickupLatitude, ride.PickupLongitude) +
+		calculateDistance(ride.PickupLatitude, ride.PickupLongitude, c.DestinationLatitude, c.DestinationLongitude)
+	detour := pooled - direct
+	return detour, detour*100 <= direct*poolMaxDetourPercent
+}
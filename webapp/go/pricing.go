@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	initialFare     = 500
+	farePerDistance = 100
+)
+
+// 配車位置から経由地を順に回って目的地までのマンハッタン距離の合計
+func calculateRouteDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude int, waypoints ...Coordinate) int {
+	distance := 0
+	lat, lon := pickupLatitude, pickupLongitude
+	for _, wp := range waypoints {
+		distance += calculateDistance(lat, lon, wp.Latitude, wp.Longitude)
+		lat, lon = wp.Latitude, wp.Longitude
+	}
+	return distance + calculateDistance(lat, lon, destLatitude, destLongitude)
+}
+
+// 距離運賃には配車位置のゾーンの倍率を掛ける。
+// 倍率はライドを作ったときのものを rides.fare_rate_percent に記録して使うので、後からゾーンを変えても運賃は変わらない
+func calculateMeteredFare(fareRatePercent, pickupLatitude, pickupLongitude, destLatitude, destLongitude int, waypoints ...Coordinate) int {
+	meteredFare := farePerDistance * calculateRouteDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude, waypoints...)
+	return meteredFare * fareRatePercent / 100
+}
+
+// 見積もり用。今のゾーンの倍率で計算する
+func calculateFare(pickupLatitude, pickupLongitude, destLatitude, destLongitude int, waypoints ...Coordinate) int {
+	fareRatePercent := zones.fareRatePercent(Coordinate{Latitude: pickupLatitude, Longitude: pickupLongitude})
+	return initialFare + calculateMeteredFare(fareRatePercent, pickupLatitude, pickupLongitude, destLatitude, destLongitude, waypoints...)
+}
+
+// rideが指定された場合は経由地もDBから読むので、waypointsは見積もり(ride == nil)のときだけ使われる
+func calculateDiscountedFare(ctx context.Context, tx *sqlx.Tx, userID string, ride *Ride, pickupLatitude, pickupLongitude, destLatitude, destLongitude int, waypoints ...Coordinate) (int, error) {
+	_, span := tracer.Start(ctx, "calculateDiscountedFare")
+	defer span.End()
+
+	var coupon Coupon
+	discount := 0
+	if ride != nil {
+		destLatitude = ride.DestinationLatitude
+		destLongitude = ride.DestinationLongitude
+		pickupLatitude = ride.PickupLatitude
+		pickupLongitude = ride.PickupLongitude
+
+		rideWaypoints, err := getRideWaypoints(ctx, tx, ride.ID)
+		if err != nil {
+			return 0, err
+		}
+		waypoints = rideWaypointCoordinates(rideWaypoints)
+
+		// すでにクーポンが紐づいているならそれの割引額を参照
+		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE used_by = ?", ride.ID); err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				return 0, err
+			}
+		} else {
+			discount = coupon.Discount
+		}
+	} else {
+		// 初回利用クーポンを最優先で使う
+		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND code = 'CP_NEW2024' AND used_by IS NULL", userID); err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				return 0, err
+			}
+
+			// 無いなら他のクーポンを付与された順番に使う
+			if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at LIMIT 1", userID); err != nil {
+				if !errors.Is(err, sql.ErrNoRows) {
+					return 0, err
+				}
+			} else {
+				discount = coupon.Discount
+			}
+		} else {
+			discount = coupon.Discount
+		}
+	}
+
+	if ride != nil {
+		return calculateRideFare(ride, discount, waypoints), nil
+	}
+	fareRatePercent := zones.fareRatePercent(Coordinate{Latitude: pickupLatitude, Longitude: pickupLongitude})
+	return calculateFareWithDiscount(fareRatePercent, pickupLatitude, pickupLongitude, destLatitude, destLongitude, discount, waypoints...), nil
+}
+
+// 割引は初乗り運賃には適用されない
+func calculateFareWithDiscount(fareRatePercent, pickupLatitude, pickupLongitude, destLatitude, destLongitude, discount int, waypoints ...Coordinate) int {
+	meteredFare := calculateMeteredFare(fareRatePercent, pickupLatitude, pickupLongitude, destLatitude, destLongitude, waypoints...)
+	discountedMeteredFare := max(meteredFare-discount, 0)
+
+	return initialFare + discountedMeteredFare
+}
+
+// 相乗りした分の割引はクーポンと同じく距離運賃から引く
+func calculateRideFare(ride *Ride, discount int, waypoints []Coordinate) int {
+	return calculateFareWithDiscount(ride.FareRatePercent, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude, discount+ride.PoolDiscount, waypoints...)
+}
+
+// 相乗りした区間(後から乗る乗客の配車位置から先の乗客の目的地まで)の距離運賃は2人で折半するので、
+// その半額を割り引く。相乗りが成立したときに計算してライドに記録しておく
+func calculatePoolDiscount(ride *Ride, sharedDistance int) int {
+	return farePerDistance * sharedDistance * ride.FareRatePercent / 100 / 2
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// リクエストの頻度をトークンバケットで制限する。バケットはルートのグループごと・認証した利用者/オーナー/椅子/管理者ごとに持ち、
+// 認証前のルートでは接続元IPごとに持つ。rate は1秒あたりに補充するトークン数、burst はバケットの容量で、rate が0以下なら制限しない。
+// RATE_LIMIT_BACKEND が memory ならインスタンスごとに(最大 RATE_LIMIT_MEMORY_SIZE 個のバケット)、redis なら全インスタンスで共有して数える。
+// Redis に繋がらないときは制限せずに通す。
+// ベンチマーカーのように少数のIPから大量に来る負荷を止めないよう、RATE_LIMIT_ENABLED=true にしたときだけ制限する。
+// 接続元IPは TRUSTED_PROXIES(カンマ区切りの CIDR か IP)から来たリクエストに限って X-Forwarded-For から取る
+var (
+	rateLimitEnabled    = GetEnv("RATE_LIMIT_ENABLED", "false") == "true"
+	rateLimitBackend    = GetEnv("RATE_LIMIT_BACKEND", "memory")
+	rateLimitMemorySize = GetEnvInt("RATE_LIMIT_MEMORY_SIZE", "100000")
+	trustedProxies      = parseTrustedProxies(GetEnv("TRUSTED_PROXIES", "127.0.0.0/8,::1/128"))
+)
+
+type rateLimiter interface {
+	// 許可しないときは次のトークンが補充されるまでの時間を返す
+	allow(ctx context.Context, key string) (bool, time.Duration, error)
+}
+
+type rateLimit struct {
+	name    string
+	rate    float64
+	burst   int
+	limiter rateLimiter
+}
+
+// 環境変数 RATE_LIMIT_<NAME>_RATE と RATE_LIMIT_<NAME>_BURST で上書きできる
+func newRateLimit(name string, rate float64, burst int) *rateLimit {
+	env := "RATE_LIMIT_" + strings.ToUpper(name)
+	l := &rateLimit{
+		name:  name,
+		rate:  GetEnvFloat(env+"_RATE", strconv.FormatFloat(rate, 'f', -1, 64)),
+		burst: GetEnvInt(env+"_BURST", strconv.Itoa(burst)),
+	}
+	switch rateLimitBackend {
+	case "memory":
+		l.limiter = newMemoryRateLimiter(name, l.rate, l.burst)
+	case "redis":
+		l.limiter = &redisRateLimiter{rate: l.rate, burst: l.burst}
+	default:
+		panic(fmt.Sprintf("invalid RATE_LIMIT_BACKEND: %s", rateLimitBackend))
+	}
+	return l
+}
+
+// 認証ミドルウェアの後ろに置くと認証した主体ごとに、前に置くと接続元IPごとに数える
+func (l *rateLimit) middleware(next http.Handler) http.Handler {
+	if !rateLimitEnabled || l.rate <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		_, span := tracer.Start(ctx, "rateLimitMiddleware")
+		defer span.End()
+
+		ok, retryAfter, err := l.limiter.allow(ctx, l.name+":"+requestIdentity(r))
+		if err != nil {
+			slog.Error("failed to check rate limit", slog.String("name", l.name), slog.Any("error", err))
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			writeError(w, http.StatusTooManyRequests, withErrorCode(errCodeRateLimited, errors.New("rate limit exceeded")))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// 認証した主体か、認証前なら接続元IP
+func requestIdentity(r *http.Request) string {
+	ctx := r.Context()
+	if user, err := UserFrom(ctx); err == nil {
+		return "user:" + user.ID
+	}
+	if owner, err := OwnerFrom(ctx); err == nil {
+		return "owner:" + owner.ID
+	}
+	if chair, err := ChairFrom(ctx); err == nil {
+		return "chair:" + chair.ID
+	}
+	if admin, err := AdminFrom(ctx); err == nil {
+		return "admin:" + admin.ID
+	}
+	return "ip:" + clientIP(r)
+}
+
+func parseTrustedProxies(s string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(v); err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(v)
+		if err != nil {
+			panic(fmt.Sprintf("invalid TRUSTED_PROXIES: %s", v))
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes
+}
+
+func isTrustedProxy(s string) bool {
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// 信用するプロキシから来たときだけ X-Forwarded-For を右から辿り、信用するプロキシでない最初のアドレスを接続元とする。
+// 左側はクライアントが自由に書けるので、先頭をそのまま使うことはしない
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrustedProxy(host) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if !isTrustedProxy(hop) {
+			return hop
+		}
+		host = hop
+	}
+	return host
+}
+
+type tokenBucket struct {
+	sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+type memoryRateLimiter struct {
+	rate    float64
+	burst   int
+	buckets *cache[string, *tokenBucket]
+}
+
+func newMemoryRateLimiter(name string, rate float64, burst int) *memoryRateLimiter {
+	// 満タンに戻るまで使われなかったバケットは、捨てて作り直しても同じ
+	ttl := time.Minute
+	if rate > 0 {
+		ttl = time.Duration(float64(burst) / rate * float64(time.Second))
+	}
+	return &memoryRateLimiter{
+		rate:  rate,
+		burst: burst,
+		buckets: NewCache[string, *tokenBucket](
+			WithCacheName("rate_limit_"+name),
+			WithCacheCapacity(rateLimitMemorySize),
+			WithCacheTTL(ttl),
+		),
+	}
+}
+
+func (l *memoryRateLimiter) allow(_ context.Context, key string) (bool, time.Duration, error) {
+	now := time.Now()
+	b, err := l.buckets.GetOrLoad(key, func() (*tokenBucket, error) {
+		return &tokenBucket{tokens: float64(l.burst), last: now}, nil
+	})
+	if err != nil {
+		return false, 0, err
+	}
+	// 使うたびに期限を延ばす
+	l.buckets.Set(key, b)
+
+	b.Lock()
+	defer b.Unlock()
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(float64(l.burst), b.tokens+elapsed.Seconds()*l.rate)
+		b.last = now
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0, nil
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second)), nil
+}
+
+// バケットは Redis のハッシュに残りのトークン数と最後に補充した時刻(ミリ秒)で持つ。時刻は Redis のものを使う
+var rateLimitScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens = tonumber(bucket[1]) or burst
+local last = tonumber(bucket[2]) or now
+if now > last then
+  tokens = math.min(burst, tokens + (now - last) / 1000 * rate)
+  last = now
+end
+local allowed = 0
+local retry_after = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+else
+  retry_after = math.ceil((1 - tokens) / rate * 1000)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'last', last)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return {allowed, retry_after}
+`)
+
+type redisRateLimiter struct {
+	rate  float64
+	burst int
+}
+
+func (l *redisRateLimiter) allow(ctx context.Context, key string) (bool, time.Duration, error) {
+	res, err := rateLimitScript.Run(ctx, rdb, []string{"rate_limit:" + key}, l.rate, l.burst).Int64Slice()
+	if err != nil {
+		return false, 0, err
+	}
+	return res[0] == 1, time.Duration(res[1]) * time.Millisecond, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+// マッチングで椅子を割り当てたら ride_assignments に期限付きで記録する。
+// 期限(RIDE_ASSIGNMENT_TIMEOUT)までに椅子がオファーに応答しなければ割り当てを取り消してライドをマッチング待ちに戻し、
+// 椅子は CHAIR_ASSIGNMENT_PENALTY の間だけ空き椅子の列の後ろに回す
+var (
+	rideAssignmentTimeout       = GetEnvDuration("RIDE_ASSIGNMENT_TIMEOUT", "30s")
+	rideAssignmentCheckInterval = GetEnvDuration("RIDE_ASSIGNMENT_CHECK_INTERVAL", "5s")
+	chairAssignmentPenalty      = GetEnvDuration("CHAIR_ASSIGNMENT_PENALTY", "1m")
+)
+
+func insertRideAssignment(ctx context.Context, tx *sqlx.Tx, rideID, chairID string) error {
+	if _, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO ride_assignments (id, ride_id, chair_id, deadline_at) VALUES (?, ?, ?, ?)`,
+		ulid.Make().String(), rideID, chairID, time.Now().Add(rideAssignmentTimeout),
+	); err != nil {
+		return fmt.Errorf("failed to insert ride assignment: %w", err)
+	}
+	return nil
+}
+
+// 割り当て中の記録を status(ACKNOWLEDGED, REJECTED, EXPIRED, REVOKED)で締める。締めた記録があればtrue
+func resolveRideAssignment(ctx context.Context, tx *sqlx.Tx, rideID, status string) (bool, error) {
+	result, err := tx.ExecContext(
+		ctx,
+		`UPDATE ride_assignments SET status = ?, resolved_at = CURRENT_TIMESTAMP(6) WHERE ride_id = ? AND status = 'ASSIGNED'`,
+		status, rideID,
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to resolve ride assignment: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// go startRideAssignmentExpiry()
+func startRideAssignmentExpiry() {
+	if rideAssignmentCheckInterval <= 0 || rideAssignmentTimeout <= 0 {
+		slog.Info("ride assignment expiry is disabled")
+		return
+	}
+	t := NewTicker(int(rideAssignmentCheckInterval.Milliseconds()), func() {
+		if err := expireRideAssignments(context.Background(), time.Now()); err != nil {
+			slog.Error("failed to expire ride assignments", slog.Any("error", err))
+		}
+	})
+	t.Start()
+}
+
+func expireRideAssignments(ctx context.Context, now time.Time) error {
+	ctx, span := tracer.Start(ctx, "expireRideAssignments")
+	defer span.End()
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	assignments := []RideAssignment{}
+	if err := tx.SelectContext(
+		ctx,
+		&assignments,
+		`SELECT * FROM ride_assignments WHERE status = 'ASSIGNED' AND deadline_at <= ? ORDER BY deadline_at FOR UPDATE SKIP LOCKED`,
+		now,
+	); err != nil {
+		return fmt.Errorf("failed to select expired ride assignments: %w", err)
+	}
+
+	deactivatedChairIDs := []string{}
+	for _, a := range assignments {
+		if _, err := tx.ExecContext(ctx, `UPDATE ride_assignments SET status = 'EXPIRED', resolved_at = CURRENT_TIMESTAMP(6) WHERE id = ?`, a.ID); err != nil {
+			return err
+		}
+
+		ride := &Ride{}
+		if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE id = ? FOR UPDATE`, a.RideID); err != nil {
+			return err
+		}
+		// 期限切れの直前に受理されていたり、既に別の椅子に割り当て直されていれば何もしない
+		if ride.Status != "MATCHING" || ride.ChairID.String != a.ChairID {
+			continue
+		}
+		if err := requeueRide(ctx, tx, ride); err != nil {
+			return err
+		}
+		deactivated, err := penalizeChair(ctx, tx, a.ChairID)
+		if err != nil {
+			return err
+		}
+		if deactivated {
+			deactivatedChairIDs = append(deactivatedChairIDs, a.ChairID)
+		}
+		slog.Info("ride assignment expired", slog.String("ride_id", a.RideID), slog.String("chair_id", a.ChairID))
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for _, chairID := range deactivatedChairIDs {
+		invalidateSubjectCache(ctx, sessionRoleChair, chairID)
+	}
+	return nil
+}
+
+// 応答しなかった椅子を空き椅子に戻すが、しばらくは他の空き椅子より後に回す。保留していた停止をしたらtrue
+func penalizeChair(ctx context.Context, tx *sqlx.Tx, chairID string) (bool, error) {
+	activeRideCount := 0
+	if err := tx.GetContext(ctx, &activeRideCount, `SELECT COUNT(*) FROM rides WHERE chair_id = ? AND status NOT IN ('COMPLETED', 'CANCELED')`, chairID); err != nil {
+		return false, err
+	}
+	if activeRideCount > 0 {
+		return false, nil
+	}
+	stale, err := isChairStale(ctx, chairID)
+	if err != nil {
+		return false, err
+	}
+	if stale {
+		return false, nil
+	}
+	deactivated, err := releaseChair(ctx, tx, chairID)
+	if err != nil {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE vacant_chair SET created_at = LOCALTIMESTAMP + make_interval(secs => ?) WHERE chair_id = ?`, chairAssignmentPenalty.Seconds(), chairID); err != nil {
+		return false, err
+	}
+	return deactivated, nil
+}
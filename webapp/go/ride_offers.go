@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/redis/go-redis/v9"
+	"github.com/samber/lo"
+)
+
+// マッチングは椅子へのオファーとして行う。
+// オファー中のライドは rides.chair_id が設定された MATCHING で、椅子への通知では OFFERED として見せる。
+// 椅子は ENROUTE を送って受理するか REJECTED を送って断る。断られたか期限切れになったライドはマッチング待ちに戻り、
+// その椅子を除いた次に良い椅子へオファーされる
+
+type vacantChairCandidate struct {
+	ChairID   string        `db:"chair_id"`
+	Penalized bool          `db:"penalized"`
+	Speed     int           `db:"speed"`
+	Latitude  sql.NullInt64 `db:"latitude"`
+	Longitude sql.NullInt64 `db:"longitude"`
+}
+
+// 配車位置に最も近い空き椅子を vacant_chair から取り出す。見つからなければ空文字。
+// 応答しなかったことで後回しにされている椅子・位置情報の無い椅子は、それ以外の椅子がいなければ選ぶ。
+// excludePremium なら上位モデルの椅子は選ばない
+func popBestVacantChair(ctx context.Context, tx *sqlx.Tx, ride *Ride, excludePremium bool) (string, error) {
+	_, span := tracer.Start(ctx, "popBestVacantChair")
+	defer span.End()
+
+	candidates := []vacantChairCandidate{}
+	if err := tx.SelectContext(ctx, &candidates, `
+SELECT vacant_chair.chair_id,
+  vacant_chair.created_at > LOCALTIMESTAMP AS penalized,
+  COALESCE(chair_models.speed, 0) AS speed,
+  loc.latitude,
+  loc.longitude
+FROM vacant_chair
+  LEFT JOIN isu1.chairs ON chairs.id = vacant_chair.chair_id
+  LEFT JOIN chair_models ON chair_models.name = chairs.model
+  LEFT JOIN LATERAL (SELECT latitude, longitude FROM isu1.chair_locations WHERE chair_id = vacant_chair.chair_id ORDER BY id DESC LIMIT 1) loc ON TRUE
+WHERE NOT EXISTS (SELECT 1 FROM ride_assignments
+  WHERE ride_assignments.ride_id = ? AND ride_assignments.chair_id = vacant_chair.chair_id AND ride_assignments.status IN ('REJECTED', 'EXPIRED'))
+ORDER BY vacant_chair.created_at
+FOR UPDATE OF vacant_chair SKIP LOCKED
+`, ride.ID); err != nil {
+		return "", err
+	}
+
+	pickup := Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude}
+	candidates = lo.Filter(candidates, func(c vacantChairCandidate, _ int) bool {
+		if excludePremium && c.Speed >= premiumChairMinSpeed {
+			return false
+		}
+		if !zones.enabled() {
+			return true
+		}
+		return c.Latitude.Valid && zones.matchable(pickup, Coordinate{Latitude: int(c.Latitude.Int64), Longitude: int(c.Longitude.Int64)})
+	})
+	if len(candidates) == 0 {
+		return "", nil
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.Penalized != b.Penalized {
+			return !a.Penalized
+		}
+		if a.Latitude.Valid != b.Latitude.Valid {
+			return a.Latitude.Valid
+		}
+		if !a.Latitude.Valid {
+			return false
+		}
+		return calculateDistance(pickup.Latitude, pickup.Longitude, int(a.Latitude.Int64), int(a.Longitude.Int64)) <
+			calculateDistance(pickup.Latitude, pickup.Longitude, int(b.Latitude.Int64), int(b.Longitude.Int64))
+	})
+
+	chairID := candidates[0].ChairID
+	if _, err := tx.ExecContext(ctx, "DELETE FROM vacant_chair WHERE chair_id = ?", chairID); err != nil {
+		return "", err
+	}
+	return chairID, nil
+}
+
+// 椅子がオファーを断った。ライドをマッチング待ちに戻し、他に進行中のライドが無ければ椅子を空き椅子に戻す。
+// 保留していた停止をしたらtrue
+func rejectRideOffer(ctx context.Context, tx *sqlx.Tx, ride *Ride, chairID string) (bool, error) {
+	if _, err := resolveRideAssignment(ctx, tx, ride.ID, "REJECTED"); err != nil {
+		return false, err
+	}
+	if err := requeueRide(ctx, tx, ride); err != nil {
+		return false, err
+	}
+
+	activeRideCount := 0
+	if err := tx.GetContext(ctx, &activeRideCount, `SELECT COUNT(*) FROM rides WHERE chair_id = ? AND status NOT IN ('COMPLETED', 'CANCELED')`, chairID); err != nil {
+		return false, err
+	}
+	if activeRideCount == 0 {
+		return releaseChair(ctx, tx, chairID)
+	}
+	return false, nil
+}
+
+// オファーの応答率は総ライド数と同じく Redis のカウンタで持つ
+// kind: offered, accepted, rejected
+func chairOfferCountKey(chairID, kind string) string {
+	return fmt.Sprintf("chair:%s:%s_offer_count", chairID, kind)
+}
+
+func addChairOfferCount(ctx context.Context, chairID, kind string) error {
+	if err := rdb.Incr(ctx, chairOfferCountKey(chairID, kind)).Err(); err != nil {
+		return fmt.Errorf("failed to add %s offer count: %w", kind, err)
+	}
+	return nil
+}
+
+type chairOfferCount struct {
+	ChairID  string
+	Offered  int
+	Accepted int
+	Rejected int
+}
+
+func (c *chairOfferCount) acceptanceRate() float64 {
+	if c.Offered == 0 {
+		return 0
+	}
+	return float64(c.Accepted) / float64(c.Offered)
+}
+
+func getChairsOfferCounts(ctx context.Context, chairIDs []string) (map[string]*chairOfferCount, error) {
+	keys := lo.FlatMap(chairIDs, func(id string, _ int) []string {
+		return []string{
+			chairOfferCountKey(id, "offered"),
+			chairOfferCountKey(id, "accepted"),
+			chairOfferCountKey(id, "rejected"),
+		}
+	})
+	if len(keys) == 0 {
+		return map[string]*chairOfferCount{}, nil
+	}
+	result := rdb.MGet(ctx, keys...)
+	if err := result.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get offer counts: %w", err)
+	}
+	vals := result.Val()
+	counts := make(map[string]*chairOfferCount, len(chairIDs))
+	for i := 0; i < len(keys); i += 3 {
+		c := &chairOfferCount{ChairID: chairIDs[i/3]}
+		for j, dst := range []*int{&c.Offered, &c.Accepted, &c.Rejected} {
+			if vals[i+j] == nil {
+				continue
+			}
+			n, err := strconv.Atoi(vals[i+j].(string))
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse offer count: %w", err)
+			}
+			*dst = n
+		}
+		counts[c.ChairID] = c
+	}
+	return counts, nil
+}
+
+func initializeChairsOfferCounts(ctx context.Context) error {
+	type offerCountFromDB struct {
+		ChairID  string `db:"chair_id"`
+		Offered  int    `db:"offered"`
+		Accepted int    `db:"accepted"`
+		Rejected int    `db:"rejected"`
+	}
+	var counts []offerCountFromDB
+	if err := db.SelectContext(ctx, &counts, `
+SELECT chair_id,
+  COUNT(*) AS offered,
+  COUNT(*) FILTER (WHERE status = 'ACKNOWLEDGED') AS accepted,
+  COUNT(*) FILTER (WHERE status = 'REJECTED') AS rejected
+FROM ride_assignments
+GROUP BY chair_id
+`); err != nil {
+		return fmt.Errorf("failed to select offer counts: %w", err)
+	}
+	if _, err := rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, c := range counts {
+			pipe.Set(ctx, chairOfferCountKey(c.ChairID, "offered"), c.Offered, 0)
+			pipe.Set(ctx, chairOfferCountKey(c.ChairID, "accepted"), c.Accepted, 0)
+			pipe.Set(ctx, chairOfferCountKey(c.ChairID, "rejected"), c.Rejected, 0)
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to set offer counts: %w", err)
+	}
+	return nil
+}
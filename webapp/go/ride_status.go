@@ -0,0 +1,23 @@
+package main
+
+import (
+	"context"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+// ライドの状態遷移を記録する。
+// ride_statuses は通知・監査用の履歴として残し、現在の状態は rides.status を同じトランザクションで更新して持つ
+func insertRideStatus(ctx context.Context, tx *sqlx.Tx, rideID string, status string) error {
+	_, span := tracer.Start(ctx, "insertRideStatus")
+	defer span.End()
+
+	if _, err := tx.ExecContext(ctx, `INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)`, ulid.Make().String(), rideID, status); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE rides SET status = ? WHERE id = ?`, status, rideID); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 経由地は position 順に PENDING -> REACHED と進む。
+// 椅子が CARRYING 中に次の経由地の座標に到達すると REACHED になり、全て REACHED になるまで ARRIVED にはならない
+
+func insertRideWaypoints(ctx context.Context, tx *sqlx.Tx, rideID string, waypoints []Coordinate) error {
+	for i, wp := range waypoints {
+		if _, err := tx.ExecContext(
+			ctx,
+			`INSERT INTO ride_waypoints (ride_id, position, latitude, longitude) VALUES (?, ?, ?, ?)`,
+			rideID, i, wp.Latitude, wp.Longitude,
+		); err != nil {
+			return fmt.Errorf("failed to insert ride waypoint: %w", err)
+		}
+	}
+	return nil
+}
+
+func getRideWaypoints(ctx context.Context, q sqlx.QueryerContext, rideID string) ([]RideWaypoint, error) {
+	waypoints := []RideWaypoint{}
+	if err := sqlx.SelectContext(ctx, q, &waypoints, `SELECT * FROM ride_waypoints WHERE ride_id = ? ORDER BY position`, rideID); err != nil {
+		return nil, fmt.Errorf("failed to select ride waypoints: %w", err)
+	}
+	return waypoints, nil
+}
+
+// ライドIDごとの経由地をまとめて取得する
+func getRidesWaypoints(ctx context.Context, q sqlx.QueryerContext, rideIDs []string) (map[string][]Coordinate, error) {
+	res := map[string][]Coordinate{}
+	if len(rideIDs) == 0 {
+		return res, nil
+	}
+	query, args, err := sqlx.In(`SELECT * FROM ride_waypoints WHERE ride_id IN (?) ORDER BY ride_id, position`, rideIDs)
+	if err != nil {
+		return nil, err
+	}
+	waypoints := []RideWaypoint{}
+	if err := sqlx.SelectContext(ctx, q, &waypoints, query, args...); err != nil {
+		return nil, fmt.Errorf("failed to select ride waypoints: %w", err)
+	}
+	for _, wp := range waypoints {
+		res[wp.RideID] = append(res[wp.RideID], Coordinate{Latitude: wp.Latitude, Longitude: wp.Longitude})
+	}
+	return res, nil
+}
+
+// 次に向かうべき経由地。無ければnil
+func getNextRideWaypoint(ctx context.Context, q sqlx.QueryerContext, rideID string) (*RideWaypoint, error) {
+	wp := &RideWaypoint{}
+	if err := sqlx.GetContext(ctx, q, wp, `SELECT * FROM ride_waypoints WHERE ride_id = ? AND status = 'PENDING' ORDER BY position LIMIT 1`, rideID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to select next ride waypoint: %w", err)
+	}
+	return wp, nil
+}
+
+func rideWaypointCoordinates(waypoints []RideWaypoint) []Coordinate {
+	res := make([]Coordinate, 0, len(waypoints))
+	for _, wp := range waypoints {
+		res = append(res, Coordinate{Latitude: wp.Latitude, Longitude: wp.Longitude})
+	}
+	return res
+}
+
+func (wp *RideWaypoint) coordinate() *Coordinate {
+	if wp == nil {
+		return nil
+	}
+	return &Coordinate{Latitude: wp.Latitude, Longitude: wp.Longitude}
+}
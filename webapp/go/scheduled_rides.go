@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// 予約ライドは SCHEDULED で作られ、pickup_at の SCHEDULED_RIDE_LEAD_TIME 前になったら MATCHING に移してマッチング対象にする。
+// 利用者が他のライドで移動中なら、そのライドが終わるまで移さない
+var (
+	scheduledRideLeadTime          = GetEnvDuration("SCHEDULED_RIDE_LEAD_TIME", "10m")
+	scheduledRideMaxAdvance        = GetEnvDuration("SCHEDULED_RIDE_MAX_ADVANCE", "168h")
+	scheduledRidePromotionInterval = GetEnvDuration("SCHEDULED_RIDE_PROMOTION_INTERVAL", "10s")
+	maxScheduledRidesPerUser       = GetEnvInt("MAX_SCHEDULED_RIDES_PER_USER", "5")
+)
+
+func validateScheduledPickupAt(pickupAt time.Time, now time.Time) error {
+	if pickupAt.Before(now.Add(scheduledRideLeadTime)) {
+		return fmt.Errorf("pickup_at must be at least %s later", scheduledRideLeadTime)
+	}
+	if pickupAt.After(now.Add(scheduledRideMaxAdvance)) {
+		return fmt.Errorf("pickup_at must be within %s", scheduledRideMaxAdvance)
+	}
+	return nil
+}
+
+// go startScheduledRidePromotion()
+func startScheduledRidePromotion() {
+	if scheduledRidePromotionInterval <= 0 {
+		slog.Info("scheduled ride promotion is disabled")
+		return
+	}
+	t := NewTicker(int(scheduledRidePromotionInterval.Milliseconds()), func() {
+		if err := promoteScheduledRides(context.Background(), time.Now()); err != nil {
+			slog.Error("failed to promote scheduled rides", slog.Any("error", err))
+		}
+	})
+	t.Start()
+}
+
+func promoteScheduledRides(ctx context.Context, now time.Time) error {
+	ctx, span := tracer.Start(ctx, "promoteScheduledRides")
+	defer span.End()
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rides := []Ride{}
+	if err := tx.SelectContext(
+		ctx,
+		&rides,
+		`SELECT * FROM rides WHERE status = 'SCHEDULED' AND pickup_at <= ? ORDER BY pickup_at FOR UPDATE SKIP LOCKED`,
+		now.Add(scheduledRideLeadTime),
+	); err != nil {
+		return fmt.Errorf("failed to select scheduled rides: %w", err)
+	}
+	for _, ride := range rides {
+		// 利用者が進行中のライドを持っている間は予約のままにして、次の回に移す
+		continuingRideCount := 0
+		if err := tx.GetContext(ctx, &continuingRideCount, `SELECT COUNT(*) FROM rides WHERE user_id = ? AND status NOT IN ('COMPLETED', 'CANCELED', 'SCHEDULED')`, ride.UserID); err != nil {
+			return err
+		}
+		if continuingRideCount > 0 {
+			continue
+		}
+		if err := insertRideStatus(ctx, tx, ride.ID, "MATCHING"); err != nil {
+			return fmt.Errorf("failed to promote scheduled ride %s: %w", ride.ID, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/isucon/isucon14/webapp/go/auth"
+	"github.com/jmoiron/sqlx"
+)
+
+// 利用者・オーナー・椅子の認証はセッションで行う。セッションは sessions にトークンのハッシュだけを保存し、
+// 最後に使われてから SESSION_TTL の間有効(残りが半分を切ったら延長する)で、ログアウトで失効する。
+// 認証のたびにDBを引かないよう SESSION_CACHE_TTL の間は最大 SESSION_CACHE_SIZE 件までプロセス内にキャッシュする。
+// 無効なトークンだったという結果も SESSION_NEGATIVE_CACHE_TTL の間はキャッシュする
+var (
+	sessionTTL              = GetEnvDuration("SESSION_TTL", "720h")
+	sessionCacheTTL         = GetEnvDuration("SESSION_CACHE_TTL", "10s")
+	sessionNegativeCacheTTL = GetEnvDuration("SESSION_NEGATIVE_CACHE_TTL", "1s")
+	sessionCacheSize        = GetEnvInt("SESSION_CACHE_SIZE", "100000")
+	sessionCookieSecure     = GetEnv("SESSION_COOKIE_SECURE", "false") == "true"
+	sessionCookieSameSite   = parseSameSite(GetEnv("SESSION_COOKIE_SAMESITE", "lax"))
+	sessionCookieDomain     = GetEnv("SESSION_COOKIE_DOMAIN", "")
+)
+
+const (
+	sessionRoleApp   = "app"
+	sessionRoleOwner = "owner"
+	sessionRoleChair = "chair"
+)
+
+var sessionCookieNames = map[string]string{
+	sessionRoleApp:   "app_session",
+	sessionRoleOwner: "owner_session",
+	sessionRoleChair: "chair_session",
+}
+
+func parseSameSite(v string) http.SameSite {
+	switch strings.ToLower(v) {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	case "lax":
+		return http.SameSiteLaxMode
+	default:
+		panic(fmt.Sprintf("invalid SESSION_COOKIE_SAMESITE: %s", v))
+	}
+}
+
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// 新しいセッションを作ってトークンを返す。トークンそのものはDBに残らない
+func createSession(ctx context.Context, q sqlx.ExecerContext, role, subjectID string) (string, error) {
+	token := secureRandomStr(32)
+	if _, err := q.ExecContext(
+		ctx,
+		`INSERT INTO sessions (token_hash, role, subject_id, expires_at) VALUES (?, ?, ?, ?)`,
+		hashSessionToken(token), role, subjectID, time.Now().Add(sessionTTL),
+	); err != nil {
+		return "", fmt.Errorf("failed to insert session: %w", err)
+	}
+	return token, nil
+}
+
+func setSessionCookie(w http.ResponseWriter, role, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Path:     "/",
+		Name:     sessionCookieNames[role],
+		Value:    token,
+		Domain:   sessionCookieDomain,
+		MaxAge:   int(sessionTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   sessionCookieSecure,
+		SameSite: sessionCookieSameSite,
+	})
+}
+
+func clearSessionCookie(w http.ResponseWriter, role string) {
+	http.SetCookie(w, &http.Cookie{
+		Path:     "/",
+		Name:     sessionCookieNames[role],
+		Value:    "",
+		Domain:   sessionCookieDomain,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   sessionCookieSecure,
+		SameSite: sessionCookieSameSite,
+	})
+}
+
+// 椅子は Authorization: Bearer でも送れる。両方あれば Authorization を優先する
+func sessionToken(r *http.Request, role string) (string, bool) {
+	if role == sessionRoleChair {
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && token != "" {
+			return token, true
+		}
+	}
+	c, err := r.Cookie(sessionCookieNames[role])
+	if err != nil || c.Value == "" {
+		return "", false
+	}
+	return c.Value, true
+}
+
+type cachedSession struct {
+	session *Session
+	subject any
+}
+
+// トークンを別のロールのクッキーで送られても本来のロールの結果を汚さないよう、キーにはロールも含める
+func sessionCacheKey(role, tokenHash string) string {
+	return role + ":" + tokenHash
+}
+
+var sessionCache = NewCache[string, *cachedSession](
+	WithCacheName("sessions"),
+	WithCacheCapacity(sessionCacheSize),
+	WithCacheTTL(sessionCacheTTL),
+	WithCacheNegative(sessionNegativeCacheTTL, isNotFound),
+)
+
+func isNotFound(err error) bool {
+	return errors.Is(err, sql.ErrNoRows)
+}
+
+// 有効なセッションの持ち主を返す。セッションが無い・失効している・期限切れなら sql.ErrNoRows
+func getSessionSubject[T any](ctx context.Context, role, token, subjectQuery string) (*T, error) {
+	ctx, span := tracer.Start(ctx, "getSessionSubject")
+	defer span.End()
+
+	tokenHash := hashSessionToken(token)
+	c, err := sessionCache.GetOrLoad(sessionCacheKey(role, tokenHash), func() (*cachedSession, error) {
+		// 同じトークンを待っている他のリクエストにも結果を返すので、このリクエストが切れても取得は続ける
+		return loadSession[T](context.WithoutCancel(ctx), role, tokenHash, subjectQuery)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !time.Now().Before(c.session.ExpiresAt) {
+		return nil, sql.ErrNoRows
+	}
+	return c.subject.(*T), nil
+}
+
+func loadSession[T any](ctx context.Context, role, tokenHash, subjectQuery string) (*cachedSession, error) {
+	now := time.Now()
+	session := &Session{}
+	if err := db.GetContext(
+		ctx,
+		session,
+		`SELECT * FROM sessions WHERE token_hash = ? AND role = ? AND revoked_at IS NULL AND expires_at > ?`,
+		tokenHash, role, now,
+	); err != nil {
+		return nil, err
+	}
+
+	// 残りが半分を切ったら延長する
+	if session.ExpiresAt.Sub(now) < sessionTTL/2 {
+		session.ExpiresAt = now.Add(sessionTTL)
+		if _, err := db.ExecContext(ctx, `UPDATE sessions SET expires_at = ?, last_used_at = ? WHERE token_hash = ?`, session.ExpiresAt, now, tokenHash); err != nil {
+			return nil, fmt.Errorf("failed to extend session: %w", err)
+		}
+	}
+
+	subject := new(T)
+	if err := db.GetContext(ctx, subject, subjectQuery, session.SubjectID); err != nil {
+		return nil, err
+	}
+	return &cachedSession{session: session, subject: subject}, nil
+}
+
+func revokeSession(ctx context.Context, role, token string) error {
+	tokenHash := hashSessionToken(token)
+	if _, err := db.ExecContext(ctx, `UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP(6) WHERE token_hash = ? AND role = ? AND revoked_at IS NULL`, tokenHash, role); err != nil {
+		return fmt.Errorf("failed to revoke session: %w", err)
+	}
+	invalidateCache(ctx, cacheInvalidation{Kind: cacheInvalidationSession, Role: role, Key: tokenHash})
+	return nil
+}
+
+// 各ロールのログアウト。認証ミドルウェアの後ろで呼ばれる
+func logout(w http.ResponseWriter, r *http.Request, role string) {
+	token, ok := sessionToken(r, role)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, errors.New(sessionCookieNames[role]+" cookie is required"))
+		return
+	}
+	if err := revokeSession(r.Context(), role, token); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	clearSessionCookie(w, role)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// 認証ミドルウェアの共通部分。セッションの持ち主をコンテキストに入れる
+func sessionAuthMiddleware[T any](role, subjectQuery string) func(http.Handler) http.Handler {
+	cookieName := sessionCookieNames[role]
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			_, span := tracer.Start(ctx, role+"AuthMiddleware")
+			defer span.End()
+
+			token, ok := sessionToken(r, role)
+			if !ok {
+				writeError(w, http.StatusUnauthorized, errors.New(cookieName+" cookie is required"))
+				return
+			}
+			subject, err := getSessionSubject[T](ctx, role, token, subjectQuery)
+			if err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					writeError(w, http.StatusUnauthorized, errors.New("invalid or expired session"))
+					return
+				}
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			ctx = auth.With(ctx, subject)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/samber/lo"
+)
+
+// 利用者は退会できる。退会しても椅子・オーナーの売上や評価の集計が変わらないようライドは残し、
+// 利用者の名前・生年月日などの個人情報を置き換え、利用者が書いた評価のコメントと決済トークンと未使用のクーポンを消し、セッションを全て失効させる。
+// 評価の点数とタグは集計に使うので残す。
+// 進行中のライドや予約があるうちは退会できない
+const (
+	deletedUserFirstname   = "退会済み"
+	deletedUserLastname    = "ユーザー"
+	deletedUserDateOfBirth = "1900-01-01"
+)
+
+var errUserHasActiveRides = errors.New("user has active rides or bookings")
+
+func deleteUser(ctx context.Context, tx *sqlx.Tx, user *User) error {
+	activeRideCount := 0
+	if err := tx.GetContext(ctx, &activeRideCount, `SELECT COUNT(*) FROM rides WHERE user_id = ? AND status NOT IN ('COMPLETED', 'CANCELED')`, user.ID); err != nil {
+		return err
+	}
+	if activeRideCount > 0 {
+		return errUserHasActiveRides
+	}
+
+	// username と invitation_code は一意なので、IDから作った値にする
+	anonymized := "del_" + user.ID
+	if _, err := tx.ExecContext(
+		ctx,
+		`UPDATE users SET username = ?, firstname = ?, lastname = ?, date_of_birth = ?, invitation_code = ?, updated_at = CURRENT_TIMESTAMP(6), deleted_at = CURRENT_TIMESTAMP(6) WHERE id = ?`,
+		anonymized, deletedUserFirstname, deletedUserLastname, deletedUserDateOfBirth, anonymized, user.ID,
+	); err != nil {
+		return fmt.Errorf("failed to anonymize user: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM evaluation_comments WHERE ride_id IN (SELECT id FROM rides WHERE user_id = ?)`, user.ID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM payment_tokens WHERE user_id = ?`, user.ID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM coupons WHERE user_id = ? AND used_by IS NULL`, user.ID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP(6) WHERE role = ? AND subject_id = ? AND revoked_at IS NULL`, sessionRoleApp, user.ID); err != nil {
+		return fmt.Errorf("failed to revoke sessions: %w", err)
+	}
+	return nil
+}
+
+type userExport struct {
+	Profile       userExportProfile        `json:"profile"`
+	Rides         []userExportRide         `json:"rides"`
+	Payments      []userExportPayment      `json:"payments"`
+	PaymentMethod *userExportPaymentMethod `json:"payment_method"`
+	Coupons       []userExportCoupon       `json:"coupons"`
+	Evaluations   []userExportEvaluation   `json:"evaluations"`
+	ExportedAt    int64                    `json:"exported_at"`
+}
+
+type userExportProfile struct {
+	ID             string `json:"id"`
+	Username       string `json:"username"`
+	FirstName      string `json:"firstname"`
+	LastName       string `json:"lastname"`
+	DateOfBirth    string `json:"date_of_birth"`
+	InvitationCode string `json:"invitation_code"`
+	CreatedAt      int64  `json:"created_at"`
+	UpdatedAt      int64  `json:"updated_at"`
+}
+
+type userExportRide struct {
+	ID                    string                        `json:"id"`
+	PickupCoordinate      Coordinate                    `json:"pickup_coordinate"`
+	DestinationCoordinate Coordinate                    `json:"destination_coordinate"`
+	Waypoints             []Coordinate                  `json:"waypoints"`
+	Status                string                        `json:"status"`
+	Statuses              []userExportRideStatus        `json:"statuses"`
+	Chair                 *getAppRidesResponseItemChair `json:"chair"`
+	PickupAt              *int64                        `json:"pickup_at"`
+	Pooled                bool                          `json:"pooled"`
+	RequestedAt           int64                         `json:"requested_at"`
+	UpdatedAt             int64                         `json:"updated_at"`
+}
+
+type userExportRideStatus struct {
+	Status    string `json:"status"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// 決済は完了したライドごとに行う
+type userExportPayment struct {
+	RideID      string  `json:"ride_id"`
+	Fare        int     `json:"fare"`
+	Discount    int     `json:"discount"`
+	CouponCode  *string `json:"coupon_code"`
+	CompletedAt int64   `json:"completed_at"`
+}
+
+// 決済トークンそのものは返さない
+type userExportPaymentMethod struct {
+	RegisteredAt int64 `json:"registered_at"`
+}
+
+type userExportCoupon struct {
+	Code      string  `json:"code"`
+	Discount  int     `json:"discount"`
+	UsedBy    *string `json:"used_by"`
+	CreatedAt int64   `json:"created_at"`
+}
+
+// 利用者が椅子に付けた評価と、椅子が利用者に付けた評価
+type userExportEvaluation struct {
+	RideID          string   `json:"ride_id"`
+	Evaluation      *int     `json:"evaluation"`
+	Comment         *string  `json:"comment"`
+	Tags            []string `json:"tags"`
+	ChairEvaluation *int     `json:"chair_evaluation"`
+}
+
+// 利用者に関するデータをまとめて返す
+func selectUserExport(ctx context.Context, tx *sqlx.Tx, user *User) (*userExport, error) {
+	rides := []rideWithDetail{}
+	if err := tx.SelectContext(
+		ctx,
+		&rides,
+		`SELECT rides.*,
+  chairs.name AS chair_name,
+  chairs.model AS chair_model,
+  owners.name AS owner_name,
+  COALESCE(coupons.discount, 0) AS discount
+FROM rides
+  LEFT JOIN isu1.chairs ON chairs.id = rides.chair_id
+  LEFT JOIN owners ON owners.id = chairs.owner_id
+  LEFT JOIN coupons ON coupons.used_by = rides.id
+WHERE rides.user_id = ?
+ORDER BY rides.id`,
+		user.ID,
+	); err != nil {
+		return nil, fmt.Errorf("failed to select rides: %w", err)
+	}
+	rideIDs := lo.Map(rides, func(ride rideWithDetail, _ int) string { return ride.ID })
+
+	waypoints, err := getRidesWaypoints(ctx, tx, rideIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	type rideComment struct {
+		RideID  string `db:"ride_id"`
+		Comment string `db:"comment"`
+	}
+	type rideTag struct {
+		RideID string `db:"ride_id"`
+		Tag    string `db:"tag"`
+	}
+	statuses := []RideStatus{}
+	comments := []rideComment{}
+	tags := []rideTag{}
+	if len(rideIDs) > 0 {
+		query, args, err := sqlx.In(`SELECT * FROM ride_statuses WHERE ride_id IN (?) ORDER BY ride_id, created_at`, rideIDs)
+		if err != nil {
+			return nil, err
+		}
+		if err := tx.SelectContext(ctx, &statuses, query, args...); err != nil {
+			return nil, fmt.Errorf("failed to select ride statuses: %w", err)
+		}
+		// 本人のデータなので非表示にされたコメントも含める
+		query, args, err = sqlx.In(`SELECT ride_id, comment FROM evaluation_comments WHERE ride_id IN (?)`, rideIDs)
+		if err != nil {
+			return nil, err
+		}
+		if err := tx.SelectContext(ctx, &comments, query, args...); err != nil {
+			return nil, fmt.Errorf("failed to select evaluation comments: %w", err)
+		}
+		query, args, err = sqlx.In(`SELECT ride_id, tag FROM evaluation_tags WHERE ride_id IN (?) ORDER BY ride_id, tag`, rideIDs)
+		if err != nil {
+			return nil, err
+		}
+		if err := tx.SelectContext(ctx, &tags, query, args...); err != nil {
+			return nil, fmt.Errorf("failed to select evaluation tags: %w", err)
+		}
+	}
+	statusesByRide := lo.GroupBy(statuses, func(s RideStatus) string { return s.RideID })
+	commentByRide := lo.SliceToMap(comments, func(c rideComment) (string, string) { return c.RideID, c.Comment })
+	tagsByRide := map[string][]string{}
+	for _, t := range tags {
+		tagsByRide[t.RideID] = append(tagsByRide[t.RideID], t.Tag)
+	}
+
+	coupons := []Coupon{}
+	if err := tx.SelectContext(ctx, &coupons, `SELECT * FROM coupons WHERE user_id = ? ORDER BY created_at`, user.ID); err != nil {
+		return nil, fmt.Errorf("failed to select coupons: %w", err)
+	}
+	couponByRide := map[string]string{}
+	for _, c := range coupons {
+		if c.UsedBy != nil {
+			couponByRide[*c.UsedBy] = c.Code
+		}
+	}
+
+	var paymentMethod *userExportPaymentMethod
+	paymentToken := &PaymentToken{}
+	if err := tx.GetContext(ctx, paymentToken, `SELECT * FROM payment_tokens WHERE user_id = ?`, user.ID); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("failed to select payment token: %w", err)
+		}
+	} else {
+		paymentMethod = &userExportPaymentMethod{RegisteredAt: paymentToken.CreatedAt.UnixMilli()}
+	}
+
+	res := &userExport{
+		Profile: userExportProfile{
+			ID:             user.ID,
+			Username:       user.Username,
+			FirstName:      user.Firstname,
+			LastName:       user.Lastname,
+			DateOfBirth:    user.DateOfBirth,
+			InvitationCode: user.InvitationCode,
+			CreatedAt:      user.CreatedAt.UnixMilli(),
+			UpdatedAt:      user.UpdatedAt.UnixMilli(),
+		},
+		Rides:         make([]userExportRide, 0, len(rides)),
+		Payments:      []userExportPayment{},
+		PaymentMethod: paymentMethod,
+		Coupons: lo.Map(coupons, func(c Coupon, _ int) userExportCoupon {
+			return userExportCoupon{Code: c.Code, Discount: c.Discount, UsedBy: c.UsedBy, CreatedAt: c.CreatedAt.UnixMilli()}
+		}),
+		Evaluations: []userExportEvaluation{},
+		ExportedAt:  time.Now().UnixMilli(),
+	}
+	for _, ride := range rides {
+		item := userExportRide{
+			ID:                    ride.ID,
+			PickupCoordinate:      Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude},
+			DestinationCoordinate: Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude},
+			Waypoints:             lo.Ternary(waypoints[ride.ID] != nil, waypoints[ride.ID], []Coordinate{}),
+			Status:                ride.Status,
+			Statuses: lo.Map(statusesByRide[ride.ID], func(s RideStatus, _ int) userExportRideStatus {
+				return userExportRideStatus{Status: s.Status, CreatedAt: s.CreatedAt.UnixMilli()}
+			}),
+			Pooled:      ride.Pooled,
+			RequestedAt: ride.CreatedAt.UnixMilli(),
+			UpdatedAt:   ride.UpdatedAt.UnixMilli(),
+		}
+		if ride.ChairID.Valid {
+			item.Chair = &getAppRidesResponseItemChair{
+				ID:    ride.ChairID.String,
+				Owner: ride.OwnerName.String,
+				Name:  ride.ChairName.String,
+				Model: ride.ChairModel.String,
+			}
+		}
+		if ride.PickupAt.Valid {
+			item.PickupAt = lo.ToPtr(ride.PickupAt.Time.UnixMilli())
+		}
+		res.Rides = append(res.Rides, item)
+
+		if ride.Status == "COMPLETED" {
+			payment := userExportPayment{
+				RideID:      ride.ID,
+				Fare:        calculateRideFare(&ride.Ride, ride.Discount, waypoints[ride.ID]),
+				Discount:    ride.Discount,
+				CompletedAt: ride.UpdatedAt.UnixMilli(),
+			}
+			if code, ok := couponByRide[ride.ID]; ok {
+				payment.CouponCode = &code
+			}
+			res.Payments = append(res.Payments, payment)
+		}
+
+		if ride.Evaluation != nil || ride.UserEvaluation != nil {
+			evaluation := userExportEvaluation{
+				RideID:          ride.ID,
+				Evaluation:      ride.Evaluation,
+				Tags:            lo.Ternary(tagsByRide[ride.ID] != nil, tagsByRide[ride.ID], []string{}),
+				ChairEvaluation: ride.UserEvaluation,
+			}
+			if comment, ok := commentByRide[ride.ID]; ok {
+				evaluation.Comment = &comment
+			}
+			res.Evaluations = append(res.Evaluations, evaluation)
+		}
+	}
+	return res, nil
+}
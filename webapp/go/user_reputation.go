@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 椅子は ARRIVED 以降のライドの乗客を1〜5で評価できる(rides.user_evaluation)。
+// 評価が USER_REPUTATION_MIN_RATINGS 件以上あり平均が LOW_USER_REPUTATION 未満の乗客は、
+// 速度が PREMIUM_CHAIR_MIN_SPEED 以上の上位モデルの椅子にはマッチングしない
+var (
+	userReputationMinRatings = GetEnvInt("USER_REPUTATION_MIN_RATINGS", "3")
+	lowUserReputation        = GetEnvFloat("LOW_USER_REPUTATION", "2.5")
+	premiumChairMinSpeed     = GetEnvInt("PREMIUM_CHAIR_MIN_SPEED", "5")
+)
+
+type userStats struct {
+	TotalRatedCount    int     `json:"total_rated_count"`
+	TotalEvaluationAvg float64 `json:"total_evaluation_avg"`
+}
+
+func (s userStats) isLowRated() bool {
+	return s.TotalRatedCount >= userReputationMinRatings && s.TotalEvaluationAvg < lowUserReputation
+}
+
+func getUserStats(ctx context.Context, tx *sqlx.Tx, userID string) (userStats, error) {
+	_, span := tracer.Start(ctx, "getUserStats")
+	defer span.End()
+	stats := userStats{}
+
+	type userStatsRow struct {
+		TotalRatedCount int             `db:"total_rated_count"`
+		TotalEvaluation sql.NullFloat64 `db:"total_evaluation"`
+	}
+	r := userStatsRow{}
+	if err := tx.GetContext(
+		ctx,
+		&r,
+		`SELECT COUNT(id) AS total_rated_count, SUM(user_evaluation) AS total_evaluation FROM rides WHERE user_id = ? AND user_evaluation IS NOT NULL`,
+		userID,
+	); err != nil {
+		return stats, err
+	}
+
+	stats.TotalRatedCount = r.TotalRatedCount
+	if r.TotalRatedCount > 0 && r.TotalEvaluation.Valid {
+		stats.TotalEvaluationAvg = r.TotalEvaluation.Float64 / float64(r.TotalRatedCount)
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,287 @@
+// Package validate はリクエストの構造体に付けた validate タグで入力を検証する。
+// タグはカンマ区切りで、次の規則を書ける。
+//
+//	required  空文字列・nil・空のスライスを許さない
+//	min=N     数値は N 以上、文字列は N 文字以上、スライスは N 個以上
+//	max=N     数値は N 以下、文字列は N 文字以下、スライスは N 個以下
+//	oneof=a b 値がスペース区切りのどれか
+//	date      YYYY-MM-DD の日付
+//	dive      以降の規則をスライスの各要素に適用する
+//
+// nil のポインタは required でなければ検証しない。構造体のフィールドとスライスの要素の構造体も検証する。
+// フィールド名はエラーに json タグの名前で入れる。
+// 知らない規則や型に合わない規則などタグの誤りは、入力の誤りの Errors ではなく ErrInvalidTag を包んだエラーで返す
+package validate
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// タグの誤り。入力ではなくプログラムの誤りなので、呼び出し側は 500 として扱う
+var ErrInvalidTag = errors.New("validate: invalid tag")
+
+func invalidTag(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrInvalidTag, fmt.Sprintf(format, args...))
+}
+
+// 検証に失敗したフィールド
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+type Errors []FieldError
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, fe := range e {
+		msgs[i] = fe.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// v は構造体かそのポインタ。全てのフィールドを検証し、失敗があれば Errors を返す。タグが誤っていれば ErrInvalidTag
+func Struct(v any) error {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Pointer {
+		if rv.IsNil() {
+			return nil
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil
+	}
+	errs := Errors{}
+	if err := validateStruct(rv, "", &errs); err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func validateStruct(rv reflect.Value, prefix string, errs *Errors) error {
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		fv := rv.Field(i)
+		// 埋め込んだ構造体のフィールドは同じ階層として扱う。型が非公開でもフィールドは json に出るので検証する
+		if f.Anonymous && fv.Kind() == reflect.Struct {
+			if err := validateStruct(fv, prefix, errs); err != nil {
+				return err
+			}
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		name := fieldName(f)
+		if name == "" {
+			continue
+		}
+		rules, err := parseRules(f.Tag.Get("validate"))
+		if err != nil {
+			return invalidTag("%s on %s", err, prefix+name)
+		}
+		if err := validateValue(fv, prefix+name, rules, errs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fieldName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	switch name {
+	case "-":
+		return ""
+	case "":
+		return f.Name
+	}
+	return name
+}
+
+type rule struct {
+	name  string
+	param string
+}
+
+// 規則の名前と、min/max の値が数値かどうかまではここで確かめる
+func parseRules(tag string) ([]rule, error) {
+	if tag == "" {
+		return nil, nil
+	}
+	parts := strings.Split(tag, ",")
+	rules := make([]rule, 0, len(parts))
+	for _, p := range parts {
+		name, param, _ := strings.Cut(p, "=")
+		switch name {
+		case "required", "date", "dive":
+			if param != "" {
+				return nil, fmt.Errorf("%s does not take a parameter", name)
+			}
+		case "min", "max":
+			if _, err := strconv.ParseFloat(param, 64); err != nil {
+				return nil, fmt.Errorf("invalid %s parameter %q", name, param)
+			}
+		case "oneof":
+			if len(strings.Fields(param)) == 0 {
+				return nil, errors.New("oneof needs at least one option")
+			}
+		default:
+			return nil, fmt.Errorf("unknown rule %q", name)
+		}
+		rules = append(rules, rule{name: name, param: param})
+	}
+	return rules, nil
+}
+
+func validateValue(v reflect.Value, field string, rules []rule, errs *Errors) error {
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			if hasRule(rules, "required") {
+				errs.add(field, "required", fmt.Sprintf("%s is required", field))
+			}
+			return nil
+		}
+		v = v.Elem()
+	}
+
+	for i, r := range rules {
+		if r.name == "dive" {
+			if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+				return invalidTag("dive is not supported on %s (%s)", field, v.Kind())
+			}
+			for j := 0; j < v.Len(); j++ {
+				if err := validateValue(v.Index(j), fmt.Sprintf("%s[%d]", field, j), rules[i+1:], errs); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		ok, err := check(v, field, r, errs)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			// 同じフィールドで2つ目以降の失敗は返さない
+			return nil
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		if _, ok := v.Interface().(time.Time); !ok {
+			return validateStruct(v, field+".", errs)
+		}
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Struct || v.Type().Elem().Kind() == reflect.Pointer {
+			for j := 0; j < v.Len(); j++ {
+				if err := validateValue(v.Index(j), fmt.Sprintf("%s[%d]", field, j), nil, errs); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func hasRule(rules []rule, name string) bool {
+	for _, r := range rules {
+		if r.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *Errors) add(field, rule, message string) {
+	*e = append(*e, FieldError{Field: field, Rule: rule, Message: message})
+}
+
+// 規則を満たしていれば true
+func check(v reflect.Value, field string, r rule, errs *Errors) (bool, error) {
+	switch r.name {
+	case "required":
+		if isEmpty(v) {
+			errs.add(field, r.name, fmt.Sprintf("%s is required", field))
+			return false, nil
+		}
+	case "min", "max":
+		bound, err := strconv.ParseFloat(r.param, 64)
+		if err != nil {
+			return false, invalidTag("invalid %s parameter on %s: %q", r.name, field, r.param)
+		}
+		n, unit, ok := measure(v)
+		if !ok {
+			return false, invalidTag("%s is not supported on %s (%s)", r.name, field, v.Kind())
+		}
+		if r.name == "min" && n < bound {
+			errs.add(field, r.name, fmt.Sprintf("%s must be at least %s%s", field, r.param, unit))
+			return false, nil
+		}
+		if r.name == "max" && n > bound {
+			errs.add(field, r.name, fmt.Sprintf("%s must be at most %s%s", field, r.param, unit))
+			return false, nil
+		}
+	case "oneof":
+		if v.Kind() != reflect.String {
+			return false, invalidTag("oneof is not supported on %s (%s)", field, v.Kind())
+		}
+		options := strings.Fields(r.param)
+		for _, o := range options {
+			if v.String() == o {
+				return true, nil
+			}
+		}
+		errs.add(field, r.name, fmt.Sprintf("%s must be one of %s", field, strings.Join(options, ", ")))
+		return false, nil
+	case "date":
+		if v.Kind() != reflect.String {
+			return false, invalidTag("date is not supported on %s (%s)", field, v.Kind())
+		}
+		if _, err := time.Parse(time.DateOnly, v.String()); err != nil {
+			errs.add(field, r.name, fmt.Sprintf("%s must be a date in YYYY-MM-DD format", field))
+			return false, nil
+		}
+	default:
+		return false, invalidTag("unknown rule %q on %s", r.name, field)
+	}
+	return true, nil
+}
+
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return v.Len() == 0
+	case reflect.Interface, reflect.Pointer:
+		return v.IsNil()
+	}
+	return false
+}
+
+// 数値はその値、文字列は文字数、スライスは要素数
+func measure(v reflect.Value) (float64, string, bool) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), "", true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), "", true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), "", true
+	case reflect.String:
+		return float64(utf8.RuneCountInString(v.String())), " characters", true
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return float64(v.Len()), " items", true
+	}
+	return 0, "", false
+}
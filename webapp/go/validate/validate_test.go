@@ -0,0 +1,227 @@
+package validate
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type coordinate struct {
+	Latitude  int `json:"latitude" validate:"min=-1000,max=1000"`
+	Longitude int `json:"longitude" validate:"min=-1000,max=1000"`
+}
+
+type base struct {
+	Name string `json:"name" validate:"required,max=5"`
+}
+
+type request struct {
+	base
+	Comment  string       `json:"comment" validate:"max=5"`
+	Note     *string      `json:"note" validate:"max=3"`
+	Evaluate *int         `json:"evaluate" validate:"required,min=1,max=5"`
+	Date     *string      `json:"date" validate:"date"`
+	Kinds    []string     `json:"kinds" validate:"required,dive,oneof=location rides"`
+	Tags     []string     `json:"tags" validate:"max=2"`
+	Pickup   *coordinate  `json:"pickup" validate:"required"`
+	Stops    []coordinate `json:"stops"`
+	Ignored  string       `json:"-" validate:"required"`
+	internal string       `validate:"required"`
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func valid() request {
+	return request{
+		base:     base{Name: "isu"},
+		Evaluate: ptr(3),
+		Kinds:    []string{"rides"},
+		Pickup:   &coordinate{},
+	}
+}
+
+// 失敗したフィールドと規則の組を返す
+func failures(t *testing.T, v any) [][2]string {
+	t.Helper()
+	err := Struct(v)
+	if err == nil {
+		return nil
+	}
+	var errs Errors
+	if !errors.As(err, &errs) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got := make([][2]string, 0, len(errs))
+	for _, e := range errs {
+		got = append(got, [2]string{e.Field, e.Rule})
+	}
+	return got
+}
+
+func TestStruct(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(r *request)
+		want   [][2]string
+	}{
+		{
+			name:   "valid",
+			modify: func(r *request) {},
+		},
+		{
+			name:   "required string in embedded struct",
+			modify: func(r *request) { r.Name = "" },
+			want:   [][2]string{{"name", "required"}},
+		},
+		{
+			name:   "required nil pointer",
+			modify: func(r *request) { r.Evaluate = nil; r.Pickup = nil },
+			want:   [][2]string{{"evaluate", "required"}, {"pickup", "required"}},
+		},
+		{
+			name:   "required empty slice",
+			modify: func(r *request) { r.Kinds = []string{} },
+			want:   [][2]string{{"kinds", "required"}},
+		},
+		{
+			name:   "max on string counts runes",
+			modify: func(r *request) { r.Comment = "いすいすい" },
+		},
+		{
+			name:   "max on string",
+			modify: func(r *request) { r.Comment = "isuisu" },
+			want:   [][2]string{{"comment", "max"}},
+		},
+		{
+			name:   "min on number through pointer",
+			modify: func(r *request) { r.Evaluate = ptr(0) },
+			want:   [][2]string{{"evaluate", "min"}},
+		},
+		{
+			name:   "max on number through pointer",
+			modify: func(r *request) { r.Evaluate = ptr(6) },
+			want:   [][2]string{{"evaluate", "max"}},
+		},
+		{
+			name:   "nil pointer without required is skipped",
+			modify: func(r *request) { r.Note = nil },
+		},
+		{
+			name:   "non-nil pointer is validated",
+			modify: func(r *request) { r.Note = ptr("isucon") },
+			want:   [][2]string{{"note", "max"}},
+		},
+		{
+			name:   "max on slice",
+			modify: func(r *request) { r.Tags = []string{"a", "b", "c"} },
+			want:   [][2]string{{"tags", "max"}},
+		},
+		{
+			name:   "dive with oneof",
+			modify: func(r *request) { r.Kinds = []string{"rides", "activity", "location", "chairs"} },
+			want:   [][2]string{{"kinds[1]", "oneof"}, {"kinds[3]", "oneof"}},
+		},
+		{
+			name:   "date",
+			modify: func(r *request) { r.Date = ptr("2024-12-08") },
+		},
+		{
+			name:   "invalid date",
+			modify: func(r *request) { r.Date = ptr("2024/12/08") },
+			want:   [][2]string{{"date", "date"}},
+		},
+		{
+			name:   "empty date",
+			modify: func(r *request) { r.Date = ptr("") },
+			want:   [][2]string{{"date", "date"}},
+		},
+		{
+			name:   "nested struct",
+			modify: func(r *request) { r.Pickup = &coordinate{Latitude: 1001, Longitude: -1001} },
+			want:   [][2]string{{"pickup.latitude", "max"}, {"pickup.longitude", "min"}},
+		},
+		{
+			name:   "slice elements",
+			modify: func(r *request) { r.Stops = []coordinate{{}, {Latitude: -1001}} },
+			want:   [][2]string{{"stops[1].latitude", "min"}},
+		},
+		{
+			name:   "first failure per field only",
+			modify: func(r *request) { r.Name = ""; r.Evaluate = ptr(0) },
+			want:   [][2]string{{"name", "required"}, {"evaluate", "min"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := valid()
+			tt.modify(&r)
+			if got := failures(t, &r); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("failures = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStructInvalidTag(t *testing.T) {
+	tests := []struct {
+		name string
+		v    any
+	}{
+		{
+			name: "unknown rule",
+			v: &struct {
+				A string `json:"a" validate:"email"`
+			}{},
+		},
+		{
+			name: "non-numeric max",
+			v: &struct {
+				A string `json:"a" validate:"max=ten"`
+			}{},
+		},
+		{
+			name: "oneof on number",
+			v: &struct {
+				A int `json:"a" validate:"oneof=1 2"`
+			}{A: 1},
+		},
+		{
+			name: "date on number",
+			v: &struct {
+				A int `json:"a" validate:"date"`
+			}{},
+		},
+		{
+			name: "min on bool",
+			v: &struct {
+				A bool `json:"a" validate:"min=1"`
+			}{},
+		},
+		{
+			name: "dive on string",
+			v: &struct {
+				A string `json:"a" validate:"dive,oneof=a"`
+			}{A: "a"},
+		},
+		{
+			name: "nested",
+			v: &struct {
+				A []struct {
+					B string `json:"b" validate:"required,unknown"`
+				} `json:"a"`
+			}{A: make([]struct {
+				B string `json:"b" validate:"required,unknown"`
+			}, 1)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Struct(tt.v)
+			if !errors.Is(err, ErrInvalidTag) {
+				t.Fatalf("err = %v, want ErrInvalidTag", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// サービスエリアはゾーン(多角形)の集まりとして zones に保存し、メモリに読み込んで使う。
+// ゾーンが1つも登録されていなければ従来通りどこでも配車できる。
+// 複数インスタンスで動かすので、管理APIで更新したインスタンス以外も ZONE_RELOAD_INTERVAL ごとに読み直す
+var zoneReloadInterval = GetEnvDuration("ZONE_RELOAD_INTERVAL", "10s")
+
+var errOutOfServiceArea = errors.New("coordinate is out of service area")
+
+type loadedZone struct {
+	Zone
+	Vertices  []Coordinate
+	Adjacents map[string]struct{}
+
+	minLatitude, maxLatitude   int
+	minLongitude, maxLongitude int
+}
+
+type zoneStore struct {
+	sync.RWMutex
+	zones []*loadedZone
+}
+
+var zones = &zoneStore{}
+
+// go startZoneReload()
+func startZoneReload() {
+	if zoneReloadInterval <= 0 {
+		return
+	}
+	t := NewTicker(int(zoneReloadInterval.Milliseconds()), func() {
+		if err := loadZones(context.Background(), db); err != nil {
+			slog.Error("failed to reload zones", slog.Any("error", err))
+		}
+	})
+	t.Start()
+}
+
+func loadZones(ctx context.Context, q sqlx.QueryerContext) error {
+	_, span := tracer.Start(ctx, "loadZones")
+	defer span.End()
+
+	rows := []Zone{}
+	if err := sqlx.SelectContext(ctx, q, &rows, `SELECT * FROM zones ORDER BY id`); err != nil {
+		return fmt.Errorf("failed to select zones: %w", err)
+	}
+	adjacencies := []ZoneAdjacency{}
+	if err := sqlx.SelectContext(ctx, q, &adjacencies, `SELECT * FROM zone_adjacencies`); err != nil {
+		return fmt.Errorf("failed to select zone adjacencies: %w", err)
+	}
+
+	loaded := make([]*loadedZone, 0, len(rows))
+	byID := make(map[string]*loadedZone, len(rows))
+	for _, row := range rows {
+		z, err := newLoadedZone(row)
+		if err != nil {
+			return err
+		}
+		loaded = append(loaded, z)
+		byID[z.ID] = z
+	}
+	for _, a := range adjacencies {
+		if z, ok := byID[a.ZoneID]; ok {
+			z.Adjacents[a.AdjacentZoneID] = struct{}{}
+		}
+	}
+
+	zones.Lock()
+	zones.zones = loaded
+	zones.Unlock()
+	return nil
+}
+
+func newLoadedZone(row Zone) (*loadedZone, error) {
+	vertices := []Coordinate{}
+	if err := json.Unmarshal([]byte(row.Polygon), &vertices); err != nil {
+		return nil, fmt.Errorf("failed to parse polygon of zone %s: %w", row.ID, err)
+	}
+	if len(vertices) < 3 {
+		return nil, fmt.Errorf("polygon of zone %s has less than 3 vertices", row.ID)
+	}
+	z := &loadedZone{
+		Zone:         row,
+		Vertices:     vertices,
+		Adjacents:    map[string]struct{}{},
+		minLatitude:  vertices[0].Latitude,
+		maxLatitude:  vertices[0].Latitude,
+		minLongitude: vertices[0].Longitude,
+		maxLongitude: vertices[0].Longitude,
+	}
+	for _, v := range vertices[1:] {
+		z.minLatitude = min(z.minLatitude, v.Latitude)
+		z.maxLatitude = max(z.maxLatitude, v.Latitude)
+		z.minLongitude = min(z.minLongitude, v.Longitude)
+		z.maxLongitude = max(z.maxLongitude, v.Longitude)
+	}
+	return z, nil
+}
+
+// 境界上の点も含む
+func (z *loadedZone) contains(c Coordinate) bool {
+	if c.Latitude < z.minLatitude || c.Latitude > z.maxLatitude || c.Longitude < z.minLongitude || c.Longitude > z.maxLongitude {
+		return false
+	}
+	inside := false
+	for i, j := 0, len(z.Vertices)-1; i < len(z.Vertices); j, i = i, i+1 {
+		a, b := z.Vertices[j], z.Vertices[i]
+		if onSegment(a, b, c) {
+			return true
+		}
+		// 経度方向に伸ばした半直線と辺の交差回数で判定する
+		if (a.Latitude > c.Latitude) != (b.Latitude > c.Latitude) {
+			x := float64(b.Longitude-a.Longitude)*float64(c.Latitude-a.Latitude)/float64(b.Latitude-a.Latitude) + float64(a.Longitude)
+			if float64(c.Longitude) < x {
+				inside = !inside
+			}
+		}
+	}
+	return inside
+}
+
+func onSegment(a, b, c Coordinate) bool {
+	cross := (b.Latitude-a.Latitude)*(c.Longitude-a.Longitude) - (b.Longitude-a.Longitude)*(c.Latitude-a.Latitude)
+	return cross == 0 &&
+		min(a.Latitude, b.Latitude) <= c.Latitude && c.Latitude <= max(a.Latitude, b.Latitude) &&
+		min(a.Longitude, b.Longitude) <= c.Longitude && c.Longitude <= max(a.Longitude, b.Longitude)
+}
+
+func (s *zoneStore) enabled() bool {
+	s.RLock()
+	defer s.RUnlock()
+	return len(s.zones) > 0
+}
+
+// 座標を含むゾーンを返す。ゾーンが重なっている場合はIDが小さい方。どこにも含まれなければnil
+func (s *zoneStore) find(c Coordinate) *loadedZone {
+	s.RLock()
+	defer s.RUnlock()
+	for _, z := range s.zones {
+		if z.contains(c) {
+			return z
+		}
+	}
+	return nil
+}
+
+// 全ての座標がサービスエリア内か確認する
+func (s *zoneStore) checkServiceArea(coordinates ...Coordinate) error {
+	if !s.enabled() {
+		return nil
+	}
+	for _, c := range coordinates {
+		if s.find(c) == nil {
+			return fmt.Errorf("%w: (%d, %d)", errOutOfServiceArea, c.Latitude, c.Longitude)
+		}
+	}
+	return nil
+}
+
+// 配車位置と椅子の位置が同じゾーンか隣接するゾーンにあればマッチングしてよい
+func (s *zoneStore) matchable(pickup, chair Coordinate) bool {
+	if !s.enabled() {
+		return true
+	}
+	pickupZone := s.find(pickup)
+	chairZone := s.find(chair)
+	if pickupZone == nil || chairZone == nil {
+		return false
+	}
+	if pickupZone.ID == chairZone.ID {
+		return true
+	}
+	_, ok := pickupZone.Adjacents[chairZone.ID]
+	return ok
+}
+
+// 配車位置のゾーンの距離運賃の倍率(%)。ゾーン外なら100
+func (s *zoneStore) fareRatePercent(pickup Coordinate) int {
+	if z := s.find(pickup); z != nil {
+		return z.FareRatePercent
+	}
+	return 100
+}
@@ -46,6 +46,7 @@ CREATE TABLE users (
     invitation_code VARCHAR(30) NOT NULL UNIQUE, -- 招待トークン
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL, -- 登録日時
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    deleted_at TIMESTAMP WITH TIME ZONE, -- 退会日時
     PRIMARY KEY (id)
 );
 
@@ -69,6 +70,13 @@ CREATE TABLE rides (
     evaluation INTEGER,                 -- 評価
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL, -- 要求日時
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    status VARCHAR(20) DEFAULT 'MATCHING' NOT NULL, -- 現在の状態(ride_statusesの最新)
+    pickup_at TIMESTAMP WITH TIME ZONE, -- 予約ライドの配車希望日時
+    pooled BOOLEAN DEFAULT FALSE NOT NULL, -- 相乗りを許可するか
+    pooled_with TEXT,                   -- 相乗り相手のライドID
+    pool_discount INTEGER DEFAULT 0 NOT NULL, -- 相乗りした区間の割引額
+    user_evaluation INTEGER,            -- 椅子による乗客の評価
+    fare_rate_percent INTEGER DEFAULT 100 NOT NULL, -- 作成時の配車位置のゾーンの距離運賃の倍率(%)
     PRIMARY KEY (id)
 );
 
@@ -76,7 +84,7 @@ DROP TABLE IF EXISTS ride_statuses;
 CREATE TABLE ride_statuses (
     id TEXT NOT NULL,                   -- 主キー
     ride_id TEXT NOT NULL,              -- ライドID
-    status VARCHAR(20) CHECK (status IN ('MATCHING', 'ENROUTE', 'PICKUP', 'CARRYING', 'ARRIVED', 'COMPLETED')) NOT NULL, -- 状態
+    status VARCHAR(20) CHECK (status IN ('SCHEDULED', 'MATCHING', 'ENROUTE', 'PICKUP', 'CARRYING', 'ARRIVED', 'COMPLETED', 'CANCELED')) NOT NULL, -- 状態
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL, -- 状態変更日時
     app_sent_at TIMESTAMP WITH TIME ZONE, -- ユーザーへの状態通知日時
     chair_sent_at TIMESTAMP WITH TIME ZONE, -- 椅子への状態通知日時
@@ -138,6 +146,14 @@ create index coupons_user_id_used_by_created_at_index
     on public.coupons (user_id, used_by, created_at);
 create index coupons_code_index
     on coupons (code);
+create index rides_user_id_id_index
+    on rides (user_id asc, id desc);
+create index rides_chair_id_status_index
+    on rides (chair_id, status);
+create index rides_user_id_status_index
+    on rides (user_id, status);
+create index rides_status_pickup_at_index
+    on rides (status, pickup_at);
 
 DROP TABLE IF EXISTS vacant_chair;
 create table if not exists vacant_chair
@@ -148,3 +164,135 @@ create table if not exists vacant_chair
     distance   integer,
     created_at timestamp default now() not null
 );
+
+DROP TABLE IF EXISTS chair_distance_checkpoints;
+CREATE TABLE chair_distance_checkpoints (
+    chair_id TEXT NOT NULL,                -- 椅子ID
+    total_distance INTEGER DEFAULT 0 NOT NULL, -- 間引き済み区間の総移動距離
+    last_location_id TEXT,                 -- 畳み込んだ最後の chair_locations.id
+    last_latitude INTEGER,                 -- 畳み込んだ最後の点(経度)
+    last_longitude INTEGER,                -- 畳み込んだ最後の点(緯度)
+    checkpoint_at TIMESTAMP WITH TIME ZONE, -- 畳み込んだ最後の点の記録日時
+    PRIMARY KEY (chair_id)
+);
+
+DROP TABLE IF EXISTS ride_waypoints;
+CREATE TABLE ride_waypoints (
+    ride_id TEXT NOT NULL,              -- ライドID
+    position INTEGER NOT NULL,          -- 経由する順番(0始まり)
+    latitude INTEGER NOT NULL,          -- 経由地(経度)
+    longitude INTEGER NOT NULL,         -- 経由地(緯度)
+    status VARCHAR(20) DEFAULT 'PENDING' CHECK (status IN ('PENDING', 'REACHED')) NOT NULL, -- 状態
+    reached_at TIMESTAMP WITH TIME ZONE, -- 到達日時
+    PRIMARY KEY (ride_id, position)
+);
+
+DROP TABLE IF EXISTS zones;
+CREATE TABLE zones (
+    id TEXT NOT NULL,                   -- ゾーンID
+    name TEXT NOT NULL,                 -- ゾーン名
+    polygon JSONB NOT NULL,             -- 頂点の配列 [{"latitude":..,"longitude":..}, ...]
+    fare_rate_percent INTEGER DEFAULT 100 NOT NULL, -- 配車位置がこのゾーンのときの距離運賃の倍率(%)
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    PRIMARY KEY (id)
+);
+
+DROP TABLE IF EXISTS zone_adjacencies;
+CREATE TABLE zone_adjacencies (
+    zone_id TEXT NOT NULL,              -- ゾーンID
+    adjacent_zone_id TEXT NOT NULL,     -- 隣接するゾーンID(両方向に登録する)
+    PRIMARY KEY (zone_id, adjacent_zone_id)
+);
+
+DROP TABLE IF EXISTS chair_schedules;
+CREATE TABLE chair_schedules (
+    chair_id TEXT NOT NULL,             -- 椅子ID
+    weekday SMALLINT NOT NULL CHECK (weekday BETWEEN 0 AND 6), -- 曜日(0が日曜)
+    start_minute INTEGER NOT NULL CHECK (start_minute BETWEEN 0 AND 1439), -- 開始時刻(0時からの分)
+    end_minute INTEGER NOT NULL CHECK (end_minute BETWEEN 0 AND 1440),     -- 終了時刻(0時からの分)。開始以前なら翌日
+    PRIMARY KEY (chair_id, weekday, start_minute)
+);
+
+DROP TABLE IF EXISTS chair_schedule_states;
+CREATE TABLE chair_schedule_states (
+    chair_id TEXT NOT NULL,             -- 椅子ID
+    in_shift BOOLEAN,                   -- 最後に反映した時点で稼働時間帯内だったか
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    PRIMARY KEY (chair_id)
+);
+
+DROP TABLE IF EXISTS chair_pending_deactivations;
+CREATE TABLE chair_pending_deactivations (
+    chair_id TEXT NOT NULL,             -- ライド完了後に停止する椅子ID
+    requested_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    PRIMARY KEY (chair_id)
+);
+
+DROP TABLE IF EXISTS ride_assignments;
+CREATE TABLE ride_assignments (
+    id TEXT NOT NULL,                   -- 主キー
+    ride_id TEXT NOT NULL,              -- ライドID
+    chair_id TEXT NOT NULL,             -- 割り当てた椅子ID
+    status VARCHAR(20) DEFAULT 'ASSIGNED' CHECK (status IN ('ASSIGNED', 'ACKNOWLEDGED', 'REJECTED', 'EXPIRED', 'REVOKED')) NOT NULL, -- 状態
+    assigned_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL, -- 割り当て日時
+    deadline_at TIMESTAMP WITH TIME ZONE NOT NULL, -- 椅子が受理すべき期限
+    resolved_at TIMESTAMP WITH TIME ZONE, -- 受理・期限切れ・取り消しの日時
+    PRIMARY KEY (id)
+);
+create index ride_assignments_status_deadline_at_index
+    on ride_assignments (status, deadline_at);
+create index ride_assignments_ride_id_status_index
+    on ride_assignments (ride_id, status);
+
+DROP TABLE IF EXISTS evaluation_comments;
+CREATE TABLE evaluation_comments (
+    ride_id TEXT NOT NULL,              -- ライドID
+    chair_id TEXT NOT NULL,             -- 評価された椅子ID
+    comment TEXT NOT NULL,              -- コメント
+    moderation_status VARCHAR(20) DEFAULT 'VISIBLE' CHECK (moderation_status IN ('VISIBLE', 'HIDDEN', 'FLAGGED')) NOT NULL, -- 表示状態
+    flag_reason TEXT,                   -- 通報理由
+    flagged_at TIMESTAMP WITH TIME ZONE, -- 通報日時
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    PRIMARY KEY (ride_id)
+);
+
+DROP TABLE IF EXISTS evaluation_tags;
+CREATE TABLE evaluation_tags (
+    ride_id TEXT NOT NULL,              -- ライドID
+    chair_id TEXT NOT NULL,             -- 評価された椅子ID
+    tag VARCHAR(30) NOT NULL,           -- タグ
+    PRIMARY KEY (ride_id, tag)
+);
+create index evaluation_tags_chair_id_tag_index
+    on evaluation_tags (chair_id, tag);
+
+DROP TABLE IF EXISTS sessions;
+CREATE TABLE sessions (
+    token_hash VARCHAR(64) NOT NULL,    -- トークンのSHA-256(16進)
+    role VARCHAR(10) NOT NULL CHECK (role IN ('app', 'owner', 'chair')), -- 利用者・オーナー・椅子のどれのセッションか
+    subject_id TEXT NOT NULL,           -- ユーザーID・オーナーID・椅子ID
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    last_used_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL, -- 最後に有効期限を延長した日時
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL, -- 有効期限
+    revoked_at TIMESTAMP WITH TIME ZONE, -- ログアウトした日時
+    PRIMARY KEY (token_hash)
+);
+create index sessions_role_subject_id_index
+    on sessions (role, subject_id);
+
+DROP TABLE IF EXISTS chair_api_keys;
+CREATE TABLE chair_api_keys (
+    id TEXT NOT NULL,                   -- APIキーID
+    chair_id TEXT NOT NULL,             -- 椅子ID
+    name VARCHAR(50) NOT NULL,          -- オーナーが付けた名前
+    key_hash VARCHAR(64) NOT NULL UNIQUE, -- キーのSHA-256(16進)
+    key_prefix VARCHAR(20) NOT NULL,    -- 見分けるためのキーの先頭部分
+    scopes TEXT NOT NULL,               -- 使えるスコープ(カンマ区切り)
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    last_used_at TIMESTAMP WITH TIME ZONE, -- 最後に使われた日時
+    revoked_at TIMESTAMP WITH TIME ZONE, -- 失効日時
+    PRIMARY KEY (id)
+);
+create index chair_api_keys_chair_id_index
+    on chair_api_keys (chair_id);
@@ -1,3 +1,73 @@
+-- rides.status を ride_statuses の最新の状態で埋める
+ALTER TABLE rides ADD COLUMN IF NOT EXISTS status VARCHAR(20) DEFAULT 'MATCHING' NOT NULL;
+UPDATE rides SET status = latest.status
+FROM (SELECT DISTINCT ON (ride_id) ride_id, status
+  FROM ride_statuses
+  ORDER BY ride_id, created_at DESC) latest
+WHERE rides.id = latest.ride_id;
+
+-- 予約ライド
+ALTER TABLE rides ADD COLUMN IF NOT EXISTS pickup_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE rides ADD COLUMN IF NOT EXISTS pooled BOOLEAN DEFAULT FALSE NOT NULL;
+ALTER TABLE rides ADD COLUMN IF NOT EXISTS pooled_with TEXT;
+ALTER TABLE rides ADD COLUMN IF NOT EXISTS pool_discount INTEGER DEFAULT 0 NOT NULL;
+ALTER TABLE ride_statuses DROP CONSTRAINT IF EXISTS ride_statuses_status_check;
+ALTER TABLE ride_statuses ADD CONSTRAINT ride_statuses_status_check
+  CHECK (status IN ('SCHEDULED', 'MATCHING', 'ENROUTE', 'PICKUP', 'CARRYING', 'ARRIVED', 'COMPLETED', 'CANCELED'));
+
+-- ライドを作ったときのゾーンの運賃倍率
+ALTER TABLE rides ADD COLUMN IF NOT EXISTS fare_rate_percent INTEGER DEFAULT 100 NOT NULL;
+
+-- 椅子による乗客の評価
+ALTER TABLE rides ADD COLUMN IF NOT EXISTS user_evaluation INTEGER;
+
+-- 退会
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP WITH TIME ZONE;
+
+-- 管理者と監査ログは初期化しても消さない
+CREATE TABLE IF NOT EXISTS admins (
+    id TEXT NOT NULL,                   -- 管理者ID
+    name VARCHAR(50) NOT NULL,          -- 管理者名
+    role VARCHAR(20) NOT NULL CHECK (role IN ('viewer', 'operator', 'superuser')), -- ロール
+    token_hash VARCHAR(64) NOT NULL UNIQUE, -- トークンのSHA-256(16進)
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP WITH TIME ZONE, -- 失効日時
+    PRIMARY KEY (id)
+);
+
+CREATE TABLE IF NOT EXISTS admin_audit_logs (
+    id TEXT NOT NULL,                   -- 監査ログID
+    admin_id TEXT NOT NULL,             -- 操作した管理者ID
+    admin_name VARCHAR(50) NOT NULL,    -- 操作した管理者名
+    action VARCHAR(50) NOT NULL,        -- 操作
+    target_type VARCHAR(20) NOT NULL,   -- 対象の種類
+    target_id TEXT NOT NULL,            -- 対象のID
+    detail JSONB,                       -- 操作の内容
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    PRIMARY KEY (id)
+);
+create index if not exists admin_audit_logs_target_index
+    on admin_audit_logs (target_type, target_id);
+create index if not exists admin_audit_logs_admin_id_index
+    on admin_audit_logs (admin_id);
+
+-- セッション。初期データのアクセストークンをそのままセッションとして引き継ぎ、アクセストークンの列は使わないので空にする
+INSERT INTO sessions (token_hash, role, subject_id, expires_at)
+  SELECT encode(sha256(access_token::bytea), 'hex'), 'app', id, CURRENT_TIMESTAMP + INTERVAL '720 hours' FROM users WHERE access_token IS NOT NULL
+  ON CONFLICT DO NOTHING;
+INSERT INTO sessions (token_hash, role, subject_id, expires_at)
+  SELECT encode(sha256(access_token::bytea), 'hex'), 'owner', id, CURRENT_TIMESTAMP + INTERVAL '720 hours' FROM owners WHERE access_token IS NOT NULL
+  ON CONFLICT DO NOTHING;
+INSERT INTO sessions (token_hash, role, subject_id, expires_at)
+  SELECT encode(sha256(access_token::bytea), 'hex'), 'chair', id, CURRENT_TIMESTAMP + INTERVAL '720 hours' FROM chairs WHERE access_token IS NOT NULL
+  ON CONFLICT DO NOTHING;
+ALTER TABLE users ALTER COLUMN access_token DROP NOT NULL;
+ALTER TABLE owners ALTER COLUMN access_token DROP NOT NULL;
+ALTER TABLE chairs ALTER COLUMN access_token DROP NOT NULL;
+UPDATE users SET access_token = NULL;
+UPDATE owners SET access_token = NULL;
+UPDATE chairs SET access_token = NULL;
+
 INSERT INTO vacant_chair (chair_id)
   SELECT chairs.id FROM chairs WHERE is_active = 1 ON CONFLICT DO NOTHING;
 DELETE FROM vacant_chair WHERE chair_id IN (